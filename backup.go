@@ -0,0 +1,608 @@
+package simplewaldb
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// backupManifestName is the name of the manifest entry in backups.
+const backupManifestName = "backup.json"
+
+// backupVersion is the version of the backup format.
+const backupVersion = 1
+
+// backupTailSize is the size of the tail of files that is checksummed in
+// backups, to detect files that were replaced between incremental backups.
+const backupTailSize = 4096
+
+// BackupFile is a file included in a backup.
+type BackupFile struct {
+	// Table is the table the file belongs to. It is empty for the manifest
+	// of the DB.
+	Table TableKey `json:"table"`
+
+	// Name is the name of the file, relative to the root dir.
+	Name string `json:"name"`
+
+	// Offset is the offset in the file of the first byte included in the
+	// backup. This is zero for full backups and the end of the file in the
+	// previous backup for incremental backups.
+	Offset int64 `json:"offset"`
+
+	// Size is the number of bytes of the file included in the backup.
+	// Offset+Size is the high-water mark of the file (i.e. its size when the
+	// backup was taken).
+	Size int64 `json:"size"`
+
+	// TailCRC is the CRC32 (Castagnoli) of the last backupTailSize bytes
+	// before the high-water mark of the file.
+	TailCRC uint32 `json:"tail_crc32c"`
+}
+
+// BackupManifest describes the contents of a backup.
+type BackupManifest struct {
+	Version   int       `json:"version"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Parent is the ID of the backup this backup is incremental to. It is
+	// empty for full backups.
+	Parent string `json:"parent,omitempty"`
+
+	Files []BackupFile `json:"files"`
+}
+
+// file returns the entry of the manifest for the given file name.
+func (m *BackupManifest) file(name string) (BackupFile, bool) {
+	for _, bf := range m.Files {
+		if bf.Name == name {
+			return bf, true
+		}
+	}
+	return BackupFile{}, false
+}
+
+// backupSource is a file being backed up. It is read from r, which is either
+// the open file f or (for the manifest of the DB, which is not append-only) a
+// copy of its contents.
+type backupSource struct {
+	BackupFile
+	r io.ReaderAt
+	f *os.File
+}
+
+// close closes the file of the source (if it has one).
+func (src *backupSource) close() {
+	if src.f != nil {
+		src.f.Close()
+	}
+}
+
+// captureBackupSources opens all files of the tables, recording their sizes.
+// Tables are read locked while their files are captured, so that no writes are
+// in progress.
+//
+// Files are opened with new handles, so that they can be read after the table
+// locks are released (even if the files are replaced by a compaction). Because
+// data and index files are append-only, the captured sizes identify a
+// consistent snapshot of each table.
+//
+// The manifest of the DB (if it has one) is the last source. It is captured
+// along with the list of tables, and only lists the tables that are backed up.
+func (db *DB) captureBackupSources() ([]backupSource, error) {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, errors.New("db is closed")
+	}
+	tableKeys := slices.Sorted(maps.Keys(db.tables))
+	tables := make([]*table, len(tableKeys))
+	locks := make([]*tableLock, len(tableKeys))
+	for i, key := range tableKeys {
+		tables[i], locks[i] = db.tables[key], db.locks[key]
+	}
+	var manifest *dbManifest
+	if db.manifest != nil {
+		manifest = db.manifest.clone()
+	}
+	db.mu.Unlock()
+
+	// Lock in the same order as transactions do, to avoid deadlocks.
+	for _, lock := range locks {
+		lock.RLock()
+	}
+	defer func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].RUnlock()
+		}
+	}()
+
+	var sources []backupSource
+	closeSources := func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}
+	addSource := func(tab *table, path string, size int64) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, backupSource{
+			BackupFile: BackupFile{
+				Table: tab.key,
+				Name:  filepath.Base(path),
+				Size:  size,
+			},
+			r: f,
+			f: f,
+		})
+		return nil
+	}
+
+	backedUp := make(map[TableKey]bool, len(tables))
+	for _, tab := range tables {
+		if tab.dropped {
+			// Dropped after the list of tables was taken.
+			continue
+		}
+		backedUp[tab.key] = true
+		dataFileNums := slices.Sorted(maps.Keys(tab.dataFiles))
+		for _, n := range dataFileNums {
+			stat, err := tab.dataFiles[n].Stat()
+			if err != nil {
+				closeSources()
+				return nil, err
+			}
+			path := dataFilePath(tab.rootDir, tab.key, n)
+			if err := addSource(tab, path, stat.Size()); err != nil {
+				closeSources()
+				return nil, err
+			}
+		}
+
+		indexPath := filepath.Join(tab.rootDir, string(tab.key)+".index")
+		if err := addSource(tab, indexPath, tab.indexSize); err != nil {
+			closeSources()
+			return nil, err
+		}
+	}
+
+	if manifest == nil {
+		return sources, nil
+	}
+	for _, tableKey := range slices.Clone(manifest.Tables) {
+		if !backedUp[tableKey] {
+			manifest.removeTable(tableKey)
+		}
+	}
+	b, err := manifest.encode()
+	if err != nil {
+		closeSources()
+		return nil, err
+	}
+	sources = append(sources, backupSource{
+		BackupFile: BackupFile{Name: manifestFileName, Size: int64(len(b))},
+		r:          bytes.NewReader(b),
+	})
+	return sources, nil
+}
+
+// writeTarFile writes a single file entry to the tar writer.
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o600,
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("short copy of %s: copied %d, expected %d", name, n, size)
+	}
+	return nil
+}
+
+// tailCRC returns the CRC32 (Castagnoli) of the last backupTailSize bytes of
+// the file before the given offset.
+func tailCRC(f io.ReaderAt, end int64) (uint32, error) {
+	start := max(end-backupTailSize, 0)
+	tail := make([]byte, end-start)
+	if _, err := f.ReadAt(tail, start); err != nil {
+		return 0, err
+	}
+	return crc32.Checksum(tail, crc32cTable), nil
+}
+
+// Backup writes a consistent backup of all tables of the DB to w, as a tar
+// stream. The first entry of the stream is a manifest (which is also
+// returned), followed by the data and index files of every table and the
+// manifest of the DB (see NewDB).
+//
+// Tables are only locked (for reading) while the sizes of their files are
+// captured. Writes done after that are not included in the backup.
+func (db *DB) Backup(w io.Writer) (*BackupManifest, error) {
+	return db.backup(w, nil)
+}
+
+// BackupIncremental writes an incremental backup of all tables of the DB to w,
+// relative to the backup described by prev (which may itself be either a full
+// or an incremental backup).
+//
+// Because data and index files are append-only, only the bytes appended to
+// each file since prev are included. The format is the same as the one of
+// Backup.
+//
+// Files that were replaced or that no longer exist since prev (for example,
+// after a compaction) cannot be backed up incrementally: in that case, an
+// error is returned and a new full backup is needed. The manifest of the DB
+// is the exception: it is always included entirely, and replaces the one of
+// prev when restoring.
+func (db *DB) BackupIncremental(w io.Writer, prev *BackupManifest) (*BackupManifest, error) {
+	if prev == nil {
+		return nil, errors.New("previous backup manifest is nil")
+	}
+	return db.backup(w, prev)
+}
+
+// backup writes a full backup (when prev is nil) or an incremental backup
+// relative to prev.
+func (db *DB) backup(w io.Writer, prev *BackupManifest) (*BackupManifest, error) {
+	// Captured ranges of data files must not be punched until they are
+	// copied.
+	db.backupMu.RLock()
+	defer db.backupMu.RUnlock()
+
+	sources, err := db.captureBackupSources()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, src := range sources {
+			src.close()
+		}
+	}()
+
+	var id [16]byte
+	rand.Read(id[:])
+	manifest := &BackupManifest{
+		Version:   backupVersion,
+		ID:        hex.EncodeToString(id[:]),
+		CreatedAt: time.Now().UTC(),
+		Files:     make([]BackupFile, len(sources)),
+	}
+	if prev != nil {
+		manifest.Parent = prev.ID
+	}
+
+	for i := range sources {
+		src := &sources[i]
+		end := src.Size
+		if prev != nil && src.Name != manifestFileName {
+			if pf, ok := prev.file(src.Name); ok {
+				hwm := pf.Offset + pf.Size
+				if end < hwm {
+					return nil, fmt.Errorf("file %q shrank since the "+
+						"previous backup; a full backup is needed", src.Name)
+				}
+				crc, err := tailCRC(src.r, hwm)
+				if err != nil {
+					return nil, err
+				}
+				if crc != pf.TailCRC {
+					return nil, fmt.Errorf("file %q was replaced since the "+
+						"previous backup; a full backup is needed", src.Name)
+				}
+				src.Offset, src.Size = hwm, end-hwm
+			}
+		}
+		if src.TailCRC, err = tailCRC(src.r, end); err != nil {
+			return nil, err
+		}
+		manifest.Files[i] = src.BackupFile
+	}
+	if prev != nil {
+		for _, pf := range prev.Files {
+			if _, ok := manifest.file(pf.Name); !ok {
+				return nil, fmt.Errorf("file %q no longer exists since the "+
+					"previous backup; a full backup is needed", pf.Name)
+			}
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	err = writeTarFile(tw, backupManifestName, int64(len(manifestJSON)),
+		manifest.CreatedAt, bytes.NewReader(manifestJSON))
+	if err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		r := io.NewSectionReader(src.r, src.Offset, src.Size)
+		err := writeTarFile(tw, src.Name, src.Size, manifest.CreatedAt, r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// validateTableFiles validates that every index record of the table in dir
+// decodes correctly and refers to data that exists in its data file.
+func validateTableFiles(dir string, tableKey TableKey) error {
+	dataSizes := make(map[uint32]int64)
+	dataFileNums, err := listDataFiles(dir, tableKey)
+	if err != nil {
+		return err
+	}
+	for _, n := range dataFileNums {
+		stat, err := os.Stat(dataFilePath(dir, tableKey, n))
+		if err != nil {
+			return err
+		}
+		dataSizes[n] = stat.Size()
+	}
+
+	indexData, err := os.ReadFile(filepath.Join(dir, string(tableKey)+".index"))
+	if err != nil {
+		return err
+	}
+	format, err := detectIndexFormat(indexData)
+	if err != nil {
+		return fmt.Errorf("table %q: %v", tableKey, err)
+	}
+	start, irSize := min(int(format.start), len(indexData)), int(format.recordSize)
+	if (len(indexData)-start)%irSize != 0 {
+		return fmt.Errorf("table %q: index size %d is not a multiple of the "+
+			"record size", tableKey, len(indexData))
+	}
+	var ir indexRecord
+	for i := start; i < len(indexData); i += irSize {
+		if err := ir.decode(indexData[i : i+irSize]); err != nil {
+			return fmt.Errorf("table %q: index record at offset %d: %v",
+				tableKey, i, err)
+		}
+		dataSize, ok := dataSizes[ir.dataFile]
+		if !ok {
+			return fmt.Errorf("table %q: index record at offset %d refers "+
+				"to missing data file %d", tableKey, i, ir.dataFile)
+		}
+		if ir.offset < 0 || ir.offset+ir.size > dataSize {
+			return fmt.Errorf("table %q: index record at offset %d refers "+
+				"to data beyond the end of data file %d", tableKey, i, ir.dataFile)
+		}
+	}
+	return nil
+}
+
+// Restore installs a backup (written by DB.Backup) read from r into rootDir.
+// rootDir MUST either not exist or be an empty dir.
+//
+// The backup is first extracted into a temporary dir (next to rootDir) and
+// validated. Only then is it moved into rootDir.
+func Restore(rootDir string, r io.Reader) error {
+	return RestoreChain(rootDir, r)
+}
+
+// RestoreChain installs a full backup followed by a chain of incremental
+// backups (written by DB.BackupIncremental), in the order they were taken, into
+// rootDir. rootDir MUST either not exist or be an empty dir.
+//
+// Each incremental backup must be relative to the backup preceding it. The
+// backups are first extracted into a temporary dir (next to rootDir) and
+// validated. Only then is the result moved into rootDir.
+func RestoreChain(rootDir string, backups ...io.Reader) error {
+	if len(backups) == 0 {
+		return errors.New("no backups to restore")
+	}
+
+	entries, err := os.ReadDir(rootDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("root dir %q is not empty", rootDir)
+	}
+
+	parentDir := filepath.Dir(filepath.Clean(rootDir))
+	if err := os.MkdirAll(parentDir, 0o700); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(parentDir, ".restore-*")
+	if err != nil {
+		return err
+	}
+	var manifest *BackupManifest
+	for _, r := range backups {
+		manifest, err = extractBackup(r, tmpDir, manifest)
+		if err != nil {
+			os.RemoveAll(tmpDir)
+			return err
+		}
+	}
+	if err := validateRestored(tmpDir, manifest); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	if err := os.Rename(tmpDir, rootDir); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+	return syncDir(parentDir)
+}
+
+// extractBackup extracts a backup into dir. If prev is not nil, the backup
+// must be incremental relative to it and its files are appended to the ones
+// already in dir.
+func extractBackup(r io.Reader, dir string, prev *BackupManifest) (*BackupManifest, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read backup manifest: %v", err)
+	}
+	if hdr.Name != backupManifestName {
+		return nil, fmt.Errorf("first entry of backup is %q instead of the manifest", hdr.Name)
+	}
+	var manifest BackupManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("unable to decode backup manifest: %v", err)
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+	switch {
+	case prev == nil && manifest.Parent != "":
+		return nil, fmt.Errorf("backup %s is incremental, not a full backup", manifest.ID)
+	case prev != nil && manifest.Parent != prev.ID:
+		return nil, fmt.Errorf("backup %s is not incremental to backup %s",
+			manifest.ID, prev.ID)
+	}
+
+	files := make(map[string]BackupFile, len(manifest.Files))
+	for _, bf := range manifest.Files {
+		if bf.Name != filepath.Base(bf.Name) || bf.Name == "." || bf.Name == ".." {
+			return nil, fmt.Errorf("invalid file name %q in manifest", bf.Name)
+		}
+		files[bf.Name] = bf
+	}
+
+	extracted := make(map[string]struct{}, len(files))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		bf, ok := files[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("file %q is not in the backup manifest", hdr.Name)
+		}
+		if hdr.Size != bf.Size {
+			return nil, fmt.Errorf("file %q has size %d instead of %d", hdr.Name,
+				hdr.Size, bf.Size)
+		}
+
+		// Files are either new (offset zero) or appended to, except for
+		// the manifest of the DB, which replaces the previous one.
+		path := filepath.Join(dir, bf.Name)
+		flag := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		switch {
+		case bf.Name == manifestFileName:
+			flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		case bf.Offset > 0:
+			flag = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(path, flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		if stat, err := f.Stat(); err != nil || stat.Size() != bf.Offset {
+			f.Close()
+			return nil, fmt.Errorf("file %q does not end at offset %d", bf.Name, bf.Offset)
+		}
+		_, err = io.Copy(f, tr)
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to extract %q: %v", bf.Name, err)
+		}
+		extracted[bf.Name] = struct{}{}
+	}
+
+	for name := range files {
+		if _, ok := extracted[name]; !ok {
+			return nil, fmt.Errorf("file %q is missing from the backup", name)
+		}
+	}
+	return &manifest, nil
+}
+
+// validateRestored validates the files restored into dir, according to the
+// manifest of the last restored backup.
+func validateRestored(dir string, manifest *BackupManifest) error {
+	tables := make(map[TableKey]struct{})
+	for _, bf := range manifest.Files {
+		f, err := os.Open(filepath.Join(dir, bf.Name))
+		if err != nil {
+			return err
+		}
+		end := bf.Offset + bf.Size
+		stat, err := f.Stat()
+		if err == nil && stat.Size() != end {
+			err = fmt.Errorf("file %q has size %d instead of %d", bf.Name,
+				stat.Size(), end)
+		}
+		var crc uint32
+		if err == nil {
+			crc, err = tailCRC(f, end)
+		}
+		if err == nil && crc != bf.TailCRC {
+			err = fmt.Errorf("file %q has a wrong checksum", bf.Name)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if bf.Name != manifestFileName {
+			tables[bf.Table] = struct{}{}
+		}
+	}
+
+	for tableKey := range tables {
+		if err := validateTableFiles(dir, tableKey); err != nil {
+			return err
+		}
+	}
+
+	// The manifest of the DB (which backups taken from DBs without one do
+	// not have) must list exactly the restored tables.
+	dbManifest, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	if dbManifest != nil {
+		if err := dbManifest.checkTables(dir); err != nil {
+			return err
+		}
+		for tableKey := range tables {
+			if !slices.Contains(dbManifest.Tables, tableKey) {
+				return fmt.Errorf("table %q is not in the manifest of the DB", tableKey)
+			}
+		}
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,326 @@
+package simplewaldb
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestBackupRestore tests backing up a DB and restoring it.
+func TestBackupRestore(t *testing.T) {
+	tab1, tab2 := TableKey("tab1"), TableKey("tab2")
+	db := newTestDB(t, WithTables(tab1, tab2), WithMaxDataFileSize(4096))
+	txc := prepTestTx(t, db, WithWriteTables(tab1, tab2))
+
+	const NBKEYS = 100
+	value := func(k, v int) []byte {
+		return bytes.Repeat([]byte{byte(k), byte(v)}, 100)
+	}
+	for k := range NBKEYS {
+		runTestTx(t, txc, func(tx Tx) error {
+			return tx.
+				Put(tab1, keyFromInt(k), value(k, 1)).
+				Put(tab2, keyFromInt(k), value(k, 2)).
+				Err()
+		})
+	}
+
+	var buf bytes.Buffer
+	manifest, err := db.Backup(&buf)
+	require.NoError(t, err)
+	require.Greater(t, len(manifest.Files), 4)
+
+	// Writes after the backup are not included in it.
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tab1, keyFromInt(NBKEYS), value(NBKEYS, 1)).Err()
+	})
+
+	// Restore into a new dir.
+	rootDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(rootDir, bytes.NewReader(buf.Bytes())))
+	restored, err := NewDB(WithRootDir(rootDir), WithTables(tab1, tab2))
+	require.NoError(t, err)
+	t.Cleanup(func() { restored.Close() })
+
+	runTestTx(t, prepTestTx(t, restored, WithReadTables(tab1, tab2)), func(tx Tx) error {
+		for k := range NBKEYS {
+			require.Equal(t, value(k, 1), tx.Get(tab1, keyFromInt(k)))
+			require.Equal(t, value(k, 2), tx.Get(tab2, keyFromInt(k)))
+		}
+		require.False(t, tx.Exists(tab1, keyFromInt(NBKEYS)))
+		return tx.Err()
+	})
+
+	// Restoring into a non-empty dir fails.
+	err = Restore(rootDir, bytes.NewReader(buf.Bytes()))
+	require.ErrorContains(t, err, "not empty")
+}
+
+// TestIncrementalBackup tests restoring a chain of incremental backups.
+func TestIncrementalBackup(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName), WithMaxDataFileSize(4096))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	value := func(k int) []byte {
+		return bytes.Repeat([]byte{byte(k)}, 500)
+	}
+	writeKeys := func(start, end int) {
+		t.Helper()
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := start; k < end; k++ {
+				tx.Put(tableName, keyFromInt(k), value(k))
+			}
+			return tx.Err()
+		})
+	}
+
+	// Full backup, then 2 incrementals.
+	var backups [][]byte
+	var manifest *BackupManifest
+	for i := range 3 {
+		writeKeys(i*10, (i+1)*10)
+		var buf bytes.Buffer
+		var err error
+		if manifest == nil {
+			manifest, err = db.Backup(&buf)
+		} else {
+			prevID := manifest.ID
+			manifest, err = db.BackupIncremental(&buf, manifest)
+			require.Equal(t, prevID, manifest.Parent)
+		}
+		require.NoError(t, err)
+		backups = append(backups, buf.Bytes())
+	}
+
+	// Incremental backups only include the appended bytes (and the entire
+	// manifest of the DB).
+	var incrementalSize int64
+	for _, bf := range manifest.Files {
+		if bf.Name == manifestFileName {
+			continue
+		}
+		incrementalSize += bf.Size
+	}
+	recordSize := 500 + recordSeparatorSize + KeySize*2 + recordPaddingSize + indexRecordSize
+	require.Equal(t, int64(10*recordSize+fileHeaderSize), incrementalSize) // One new data file.
+
+	readers := func(bs ...[]byte) []io.Reader {
+		var res []io.Reader
+		for _, b := range bs {
+			res = append(res, bytes.NewReader(b))
+		}
+		return res
+	}
+
+	// Restore the full chain.
+	rootDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreChain(rootDir, readers(backups...)...))
+	restored, err := NewDB(WithRootDir(rootDir), WithTables(tableName))
+	require.NoError(t, err)
+	t.Cleanup(func() { restored.Close() })
+	runTestTx(t, prepTestTx(t, restored, WithReadTables(tableName)), func(tx Tx) error {
+		for k := range 30 {
+			require.Equal(t, value(k), tx.Get(tableName, keyFromInt(k)))
+		}
+		return tx.Err()
+	})
+
+	// Chains out of order or without the full backup fail.
+	err = RestoreChain(filepath.Join(t.TempDir(), "r"), readers(backups[0], backups[2])...)
+	require.ErrorContains(t, err, "not incremental")
+	err = RestoreChain(filepath.Join(t.TempDir(), "r"), readers(backups[1:]...)...)
+	require.ErrorContains(t, err, "not a full backup")
+
+	// Incremental backups after a compaction are not possible.
+	require.NoError(t, db.Compact(tableName))
+	_, err = db.BackupIncremental(io.Discard, manifest)
+	require.ErrorContains(t, err, "a full backup is needed")
+}
+
+// TestBackupRotatedSeparator tests that the manifest of the DB is backed up
+// and restored, so that restored DBs keep the rotations of their separator.
+func TestBackupRotatedSeparator(t *testing.T) {
+	tab1, tab2 := TableKey("tab1"), TableKey("tab2")
+	seps := []string{strings.Repeat("a1", 31), strings.Repeat("b2", 31)}
+	rootDir := t.TempDir()
+	db, err := NewDB(WithRootDir(rootDir), WithSeparatorHex(seps[0]), WithTables(tab1, tab2))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	txc := prepTestTx(t, db, WithWriteTables(tab1, tab2))
+	putAll := func(v int) {
+		t.Helper()
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range 5 {
+				tx.Put(tab1, keyFromInt(k), []byte{byte(k), byte(v)})
+				tx.Put(tab2, keyFromInt(k), []byte{byte(k), byte(v)})
+			}
+			return tx.Err()
+		})
+	}
+
+	// Full backup before rotating the separator and both a full and an
+	// incremental backup after it.
+	putAll(0)
+	var full1, full2, incr bytes.Buffer
+	manifest, err := db.Backup(&full1)
+	require.NoError(t, err)
+	require.NoError(t, db.RotateSeparator(seps[1]))
+	putAll(1)
+	_, err = db.Backup(&full2)
+	require.NoError(t, err)
+	_, err = db.BackupIncremental(&incr, manifest)
+	require.NoError(t, err)
+	wantManifest, err := os.ReadFile(filepath.Join(rootDir, manifestFileName))
+	require.NoError(t, err)
+
+	check := func(rootDir string) {
+		t.Helper()
+		gotManifest, err := os.ReadFile(filepath.Join(rootDir, manifestFileName))
+		require.NoError(t, err)
+		require.Equal(t, wantManifest, gotManifest)
+
+		// The restored DB can only be opened with the new separator, and
+		// verified with the previous one.
+		_, err = NewDB(WithRootDir(rootDir), WithSeparatorHex(seps[0]), WithDiscoverTables())
+		require.ErrorIs(t, err, ErrSeparatorMismatch)
+		report, err := Verify(rootDir, WithSeparatorHex(seps[1]), WithPreviousSeparatorsHex(seps[0]))
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.Issues)
+		require.Equal(t, map[TableKey]int{tab1: 10, tab2: 10}, report.Records)
+
+		restored, err := NewDB(WithRootDir(rootDir), WithSeparatorHex(seps[1]), WithDiscoverTables())
+		require.NoError(t, err)
+		defer restored.Close()
+		require.Equal(t, []TableKey{tab1, tab2}, restored.Tables())
+		runTestTx(t, prepTestTx(t, restored, WithReadTables(tab1, tab2)), func(tx Tx) error {
+			for k := range 5 {
+				require.Equal(t, []byte{byte(k), 1}, tx.Get(tab1, keyFromInt(k)))
+				require.Equal(t, []byte{byte(k), 1}, tx.Get(tab2, keyFromInt(k)))
+			}
+			return tx.Err()
+		})
+	}
+	restoredDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(restoredDir, bytes.NewReader(full2.Bytes())))
+	check(restoredDir)
+	chainDir := filepath.Join(t.TempDir(), "chain")
+	require.NoError(t, RestoreChain(chainDir, &full1, &incr))
+	check(chainDir)
+
+	// Only the tables that are backed up are in the backed up manifest.
+	require.NoError(t, db.Close())
+	db, err = NewDB(WithRootDir(rootDir), WithSeparatorHex(seps[1]), WithTables(tab2))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf)
+	require.NoError(t, err)
+	partialDir := filepath.Join(t.TempDir(), "partial")
+	require.NoError(t, Restore(partialDir, &buf))
+	m, err := readManifest(partialDir)
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{tab2}, m.Tables)
+	require.Len(t, m.Rotations, 1)
+	require.Equal(t, map[TableKey]uint32{tab2: 1}, m.Rotations[0].DataFiles)
+}
+
+// TestRestoreValidation tests that invalid backups are not restored.
+func TestRestoreValidation(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	runTestTx(t, prepTestTx(t, db, WithWriteTables(tableName)), func(tx Tx) error {
+		return tx.Put(tableName, Key{0: 1}, []byte("value")).Err()
+	})
+	var buf bytes.Buffer
+	_, err := db.Backup(&buf)
+	require.NoError(t, err)
+
+	// rewriteBackup rewrites the backup, changing the contents of files.
+	rewriteBackup := func(f func(name string, data []byte) []byte) []byte {
+		var out bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		tw := tar.NewWriter(&out)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			data, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			data = f(hdr.Name, data)
+			if data == nil {
+				continue
+			}
+			hdr.Size = int64(len(data))
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err = tw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return out.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		f       func(name string, data []byte) []byte
+		wantErr string
+	}{{
+		name: "missing file",
+		f: func(name string, data []byte) []byte {
+			if name == "test.data" {
+				return nil
+			}
+			return data
+		},
+		wantErr: "missing",
+	}, {
+		name: "truncated data file",
+		f: func(name string, data []byte) []byte {
+			if name == "test.data" {
+				return data[:2]
+			}
+			return data
+		},
+		wantErr: "size",
+	}, {
+		name: "corrupted index",
+		f: func(name string, data []byte) []byte {
+			if name == "test.index" {
+				data[0] = 'x'
+			}
+			return data
+		},
+		wantErr: "wrong checksum",
+	}, {
+		name: "missing DB manifest",
+		f: func(name string, data []byte) []byte {
+			if name == manifestFileName {
+				return nil
+			}
+			return data
+		},
+		wantErr: "missing",
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rootDir := filepath.Join(t.TempDir(), "restored")
+			err := Restore(rootDir, bytes.NewReader(rewriteBackup(tc.f)))
+			require.ErrorContains(t, err, tc.wantErr)
+
+			// Nothing was installed and no temp dirs were left.
+			_, err = os.Stat(rootDir)
+			require.ErrorIs(t, err, os.ErrNotExist)
+			entries, err := os.ReadDir(filepath.Dir(rootDir))
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
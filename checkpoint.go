@@ -0,0 +1,246 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// checkpointMagic is the magic string at the start of checkpoint files.
+var checkpointMagic = [8]byte{'s', 'w', 'd', 'b', 'c', 'k', 'p', '1'}
+
+// checkpointEntrySize is the size of each index entry in a checkpoint: key,
+// data file, offset, size (-1 for tombstones), previous index offset, index
+// offset and checksum (zero when the index records have no checksums).
+const checkpointEntrySize = KeySize + 4 + 8 + 8 + 8 + 8 + 4
+
+// checkpointPath returns the path to the checkpoint file of a table.
+func checkpointPath(rootDir string, tableName TableKey) string {
+	return filepath.Join(rootDir, string(tableName)+".checkpoint")
+}
+
+// checkpoint is a snapshot of the in-memory index of a table, which allows
+// opening the table by only reading the index records written after it.
+//
+// A checkpoint file is:
+// 8 bytes magic
+// 8 bytes index offset covered by the checkpoint (including the header)
+// 8 bytes size of the index records
+// index record size bytes of the last index record covered by the checkpoint
+// 4 bytes number of data files
+// for each data file:
+//
+//	4 bytes data file number
+//	8 bytes end of the last indexed record of the data file
+//
+// 8 bytes number of entries
+// checkpointEntrySize bytes for each entry
+// 4 bytes CRC32 (Castagnoli) of all previous bytes
+//
+// All integers are big endian. The last covered index record is used to detect
+// checkpoints that do not match the index file (for example, because the index
+// was replaced by a compaction).
+type checkpoint struct {
+	indexOffset int64
+	irSize      int64
+	lastRecord  []byte
+	dataEnds    map[uint32]int64
+	index       map[Key]*indexRecord
+}
+
+// encodeCheckpoint encodes a checkpoint of the table's committed index.
+//
+// The caller must hold the table's write lock, and the table must not have any
+// pending writes.
+func (tab *table) encodeCheckpoint() ([]byte, error) {
+	lastRecord := make([]byte, tab.irSize)
+	if _, err := tab.indexFile.ReadAt(lastRecord, tab.indexSize-tab.irSize); err != nil {
+		return nil, fmt.Errorf("error reading last index record: %v", err)
+	}
+
+	size := len(checkpointMagic) + 8 + 8 + int(tab.irSize) + 4 +
+		len(tab.dataFiles)*12 + 8 + tab.keys.Len()*checkpointEntrySize + 4
+	b := make([]byte, 0, size)
+	b = append(b, checkpointMagic[:]...)
+	b = binary.BigEndian.AppendUint64(b, uint64(tab.indexSize))
+	b = binary.BigEndian.AppendUint64(b, uint64(tab.irSize))
+	b = append(b, lastRecord...)
+
+	// The data files may have orphaned data after their last indexed record
+	// (e.g. of a commit that failed), so their sizes are not used.
+	b = binary.BigEndian.AppendUint32(b, uint32(len(tab.dataFiles)))
+	for n := range tab.dataFiles {
+		b = binary.BigEndian.AppendUint32(b, n)
+		b = binary.BigEndian.AppendUint64(b, uint64(tab.dataEnds[n]))
+	}
+
+	b = binary.BigEndian.AppendUint64(b, uint64(tab.keys.Len()))
+	for key := range tab.allKeys() {
+		ir := tab.index[key]
+		size := ir.size
+		if ir.deleted {
+			size = tombstoneSize
+		}
+		b = append(b, key[:]...)
+		b = binary.BigEndian.AppendUint32(b, ir.dataFile)
+		b = binary.BigEndian.AppendUint64(b, uint64(ir.offset))
+		b = binary.BigEndian.AppendUint64(b, uint64(size))
+		b = binary.BigEndian.AppendUint64(b, uint64(ir.prevIndexOffset))
+		b = binary.BigEndian.AppendUint64(b, uint64(ir.indexOffset))
+		b = binary.BigEndian.AppendUint32(b, ir.checksum)
+	}
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crc32cTable))
+	return b, nil
+}
+
+// decodeCheckpoint decodes a checkpoint file.
+func decodeCheckpoint(b []byte) (*checkpoint, error) {
+	minSize := len(checkpointMagic) + 8 + 8 + indexRecordSizeV2 + 4 + 8 + 4
+	if len(b) < minSize {
+		return nil, errors.New("checkpoint is too short")
+	}
+	if [8]byte(b[:8]) != checkpointMagic {
+		return nil, errors.New("wrong checkpoint magic")
+	}
+	crc := binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(b[:len(b)-4], crc32cTable) != crc {
+		return nil, errors.New("wrong checkpoint checksum")
+	}
+	b = b[8 : len(b)-4]
+
+	cp := &checkpoint{
+		indexOffset: int64(binary.BigEndian.Uint64(b)),
+		irSize:      int64(binary.BigEndian.Uint64(b[8:])),
+	}
+	if cp.irSize != indexRecordSizeV2 && cp.irSize != indexRecordSize {
+		return nil, fmt.Errorf("wrong checkpoint index record size %d", cp.irSize)
+	}
+	if cp.indexOffset <= 0 {
+		return nil, fmt.Errorf("wrong checkpoint index offset %d", cp.indexOffset)
+	}
+	b = b[16:]
+	if int64(len(b)) < cp.irSize+4+8 {
+		return nil, errors.New("checkpoint is too short")
+	}
+	cp.lastRecord, b = b[:cp.irSize], b[cp.irSize:]
+
+	nbDataFiles := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) < uint64(nbDataFiles)*12+8 {
+		return nil, errors.New("checkpoint data files are truncated")
+	}
+	cp.dataEnds = make(map[uint32]int64, nbDataFiles)
+	for range nbDataFiles {
+		cp.dataEnds[binary.BigEndian.Uint32(b)] = int64(binary.BigEndian.Uint64(b[4:]))
+		b = b[12:]
+	}
+
+	nbEntries := binary.BigEndian.Uint64(b)
+	b = b[8:]
+	if uint64(len(b)) != nbEntries*checkpointEntrySize {
+		return nil, errors.New("wrong size of checkpoint entries")
+	}
+	cp.index = make(map[Key]*indexRecord, nbEntries)
+	for ; len(b) > 0; b = b[checkpointEntrySize:] {
+		ir := new(indexRecord)
+		copy(ir.key[:], b)
+		e := b[KeySize:]
+		ir.dataFile = binary.BigEndian.Uint32(e)
+		ir.offset = int64(binary.BigEndian.Uint64(e[4:]))
+		ir.size = int64(binary.BigEndian.Uint64(e[12:]))
+		ir.prevIndexOffset = int64(binary.BigEndian.Uint64(e[20:]))
+		ir.indexOffset = int64(binary.BigEndian.Uint64(e[28:]))
+		ir.checksum = binary.BigEndian.Uint32(e[36:])
+		ir.hasChecksum = cp.irSize == indexRecordSize
+		ir.deleted = ir.size == tombstoneSize
+		if ir.deleted {
+			ir.size = 0
+		}
+		cp.index[ir.key] = ir
+	}
+	return cp, nil
+}
+
+// loadCheckpoint loads the checkpoint of a table, if it exists and matches the
+// table's index file (which is in the given format). It returns nil (and no
+// error) if there is no checkpoint.
+func loadCheckpoint(rootDir string, tableName TableKey, indexFile *os.File, format indexFormat) (*checkpoint, error) {
+	b, err := os.ReadFile(checkpointPath(rootDir, tableName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp, err := decodeCheckpoint(b)
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.irSize != format.recordSize {
+		return nil, errors.New("checkpoint does not match the index format")
+	}
+	if cp.indexOffset <= format.start || (cp.indexOffset-format.start)%cp.irSize != 0 {
+		return nil, fmt.Errorf("wrong checkpoint index offset %d", cp.indexOffset)
+	}
+	lastRecord := make([]byte, cp.irSize)
+	if _, err := indexFile.ReadAt(lastRecord, cp.indexOffset-cp.irSize); err != nil {
+		return nil, fmt.Errorf("error reading last checkpointed index record: %v", err)
+	}
+	if !bytes.Equal(lastRecord, cp.lastRecord) {
+		return nil, errors.New("checkpoint does not match the index")
+	}
+	return cp, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint of the table with one of
+// its current committed index.
+//
+// The caller must hold the table's write lock, and the table must not have any
+// pending writes.
+func (tab *table) writeCheckpoint() error {
+	if tab.indexSize == tab.indexStart {
+		return nil
+	}
+	b, err := tab.encodeCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(checkpointPath(tab.rootDir, tab.key), b); err != nil {
+		return err
+	}
+	tab.checkpointOffset = tab.indexSize
+	return nil
+}
+
+// maybeCheckpoint writes a checkpoint of the table if enough index records were
+// written since the last one (see WithCheckpointInterval).
+//
+// The caller must hold the table's write lock, and the table must not have any
+// pending writes.
+func (tab *table) maybeCheckpoint() {
+	interval := tab.opts.checkpointInterval
+	if interval <= 0 || tab.indexSize-tab.checkpointOffset < interval*tab.irSize {
+		return
+	}
+
+	// Checkpoints are only an optimization for opening the table: if one
+	// cannot be written, the previous one (which is still valid) is kept,
+	// and writing is attempted again after the next commit.
+	_ = tab.writeCheckpoint()
+}
+
+// removeCheckpoint removes the checkpoint of a table. This must be done before
+// its index file is replaced.
+func removeCheckpoint(rootDir string, tableName TableKey) error {
+	err := os.Remove(checkpointPath(rootDir, tableName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
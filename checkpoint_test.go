@@ -0,0 +1,155 @@
+package simplewaldb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestCheckpoints tests writing index checkpoints and opening tables from them.
+func TestCheckpoints(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName), WithCheckpointInterval(10)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	// Write 25 records, 5 at a time. Checkpoints are written after 10 and
+	// 20 records.
+	cpPath := checkpointPath(rootDir, tableName)
+	for i := range 5 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range 5 {
+				if i == 2 && k == 0 {
+					tx.Delete(tableName, keyFromInt(k))
+					continue
+				}
+				tx.Put(tableName, keyFromInt(i*3+k), []byte{byte(i), byte(k)})
+			}
+			return tx.Err()
+		})
+		_, err := os.Stat(cpPath)
+		if i < 1 {
+			require.ErrorIs(t, err, os.ErrNotExist)
+		} else {
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, int64(fileHeaderSize+20*indexRecordSize), db.tables[tableName].checkpointOffset)
+	require.NoError(t, db.Close())
+
+	// tableState opens the DB and returns the state of the table.
+	type tableState struct {
+		index     map[Key]*indexRecord
+		keys      []Key
+		nbLive    int
+		indexSize int64
+	}
+	openState := func() (tableState, int64) {
+		t.Helper()
+		db, err := NewDB(opts...)
+		require.NoError(t, err)
+		defer db.Close()
+		tab := db.tables[tableName]
+		return tableState{tab.index, slices.Collect(tab.allKeys()), tab.nbLive, tab.indexSize}, tab.checkpointOffset
+	}
+
+	// Opening from the checkpoint results in the same state as reading
+	// the entire index.
+	cpState, cpOffset := openState()
+	require.Equal(t, int64(fileHeaderSize+20*indexRecordSize), cpOffset)
+	cpData, err := os.ReadFile(cpPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(cpPath))
+	fullState, cpOffset := openState()
+	require.Equal(t, int64(fileHeaderSize), cpOffset)
+	require.Equal(t, fullState, cpState)
+
+	// Invalid checkpoints are ignored.
+	badData := append([]byte(nil), cpData...)
+	badData[len(badData)-5] ^= 0xff
+	require.NoError(t, os.WriteFile(cpPath, badData, 0o600))
+	state, cpOffset := openState()
+	require.Equal(t, int64(fileHeaderSize), cpOffset)
+	require.Equal(t, fullState, state)
+
+	// The records covered by the checkpoint are not read.
+	require.NoError(t, os.WriteFile(cpPath, cpData, 0o600))
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	f, err := os.OpenFile(indexPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("x"), fileHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	state, _ = openState()
+	require.Equal(t, fullState, state)
+	require.NoError(t, os.Rename(cpPath, cpPath+".bak"))
+	_, err = NewDB(opts...)
+	require.Error(t, err)
+	require.NoError(t, os.Rename(cpPath+".bak", cpPath))
+
+	// Compacting removes the checkpoint, since it no longer matches the
+	// index.
+	f, err = os.OpenFile(indexPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("0"), fileHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Compact(tableName))
+	_, err = os.Stat(cpPath)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, db.Close())
+}
+
+// TestCheckpointOrphanedData tests that data left after the last indexed
+// record of a data file (by a commit that failed) is quarantined when opening
+// the table from a checkpoint written after the failure.
+func TestCheckpointOrphanedData(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, Key{1}, []byte("committed")).Err()
+	})
+
+	// Simulate a commit that fails after its data was appended.
+	tab := db.tables[tableName]
+	dataSize, err := tab.dataFile.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	tx, err := db.BeginTx(txc)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(tableName, Key{2}, []byte("failed")).Err())
+	_, err = tab.prepareCommit()
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+	stat, err := tab.dataFile.Stat()
+	require.NoError(t, err)
+	orphaned := stat.Size() - dataSize
+	require.Positive(t, orphaned)
+
+	require.NoError(t, tab.writeCheckpoint())
+	require.NoError(t, db.Close())
+
+	// The table is opened from the checkpoint, and the orphaned data is
+	// quarantined.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, db.tables[tableName].indexSize, db.tables[tableName].checkpointOffset)
+	repairs := db.Repairs()
+	require.Len(t, repairs, 1)
+	require.Equal(t, map[uint32]int64{0: orphaned}, repairs[0].OrphanedDataBytes)
+	stat, err = os.Stat(dataFilePath(rootDir, tableName, 0))
+	require.NoError(t, err)
+	require.Equal(t, dataSize, stat.Size())
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"matheusd.com/simplewaldb"
+)
+
+func runTables(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("tables", &df)
+	fs.Parse(args)
+
+	tables, err := simplewaldb.ListTables(df.rootDir)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		fmt.Println(table)
+	}
+	return nil
+}
+
+func runKeys(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("keys", &df)
+	table := fs.String("table", "", "table to list")
+	prefixHex := fs.String("prefix", "", "only list keys with this (hex) prefix")
+	fs.Parse(args)
+
+	prefix, err := hex.DecodeString(*prefixHex)
+	if err != nil {
+		return fmt.Errorf("invalid prefix: %v", err)
+	}
+	return df.runTx(*table, false, func(tab *simplewaldb.TxTable) error {
+		for key := range tab.PrefixKeys(prefix) {
+			fmt.Printf("%x\n", key)
+		}
+		return nil
+	})
+}
+
+func runGet(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("get", &df)
+	table := fs.String("table", "", "table to read from")
+	keyHex := fs.String("key", "", "key to read (hex)")
+	raw := fs.Bool("raw", false, "print the value as is (without a trailing line feed)")
+	fs.Parse(args)
+
+	key, err := parseKey(*keyHex)
+	if err != nil {
+		return err
+	}
+	return df.runTx(*table, false, func(tab *simplewaldb.TxTable) error {
+		value, err := tab.Get(key)
+		if err != nil {
+			return err
+		}
+		if *raw {
+			_, err = os.Stdout.Write(value)
+			return err
+		}
+		fmt.Println(formatValue(value, false))
+		return nil
+	})
+}
+
+func runPut(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("put", &df)
+	table := fs.String("table", "", "table to write to")
+	keyHex := fs.String("key", "", "key to write (hex)")
+	valueArg := fs.String("value", "", "value to write (hex, unless -raw is set); read from stdin if empty")
+	raw := fs.Bool("raw", false, "the value is not hex-encoded")
+	fs.Parse(args)
+
+	key, err := parseKey(*keyHex)
+	if err != nil {
+		return err
+	}
+	value := []byte(*valueArg)
+	if *valueArg == "" {
+		if value, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+	if !*raw {
+		// Hex values read from stdin usually end with a line feed.
+		if value, err = hex.DecodeString(string(bytes.TrimSpace(value))); err != nil {
+			return fmt.Errorf("invalid value: %v", err)
+		}
+	}
+	return df.runTx(*table, true, func(tab *simplewaldb.TxTable) error {
+		return tab.Put(key, value)
+	})
+}
+
+func runHistory(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("history", &df)
+	table := fs.String("table", "", "table to read from")
+	keyHex := fs.String("key", "", "key to read (hex)")
+	raw := fs.Bool("raw", false, "print values as is instead of hex-encoded")
+	fs.Parse(args)
+
+	key, err := parseKey(*keyHex)
+	if err != nil {
+		return err
+	}
+	return df.runTx(*table, false, func(tab *simplewaldb.TxTable) error {
+		var found bool
+		for v, err := range tab.History(key) {
+			if err != nil {
+				return err
+			}
+			found = true
+			fmt.Printf("index offset %d, data file %d, offset %d, size %d",
+				v.IndexOffset, v.DataFile, v.Offset, v.Size)
+			if v.Deleted {
+				fmt.Println(", deleted")
+				continue
+			}
+			fmt.Printf("\n%s\n", formatValue(v.Data, *raw))
+		}
+		if !found {
+			return simplewaldb.ErrKeyNotFound(key)
+		}
+		return nil
+	})
+}
+
+func runStats(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("stats", &df)
+	tableList := fs.String("tables", "", "comma-separated list of tables (default: all tables)")
+	fs.Parse(args)
+
+	var tables []simplewaldb.TableKey
+	if *tableList != "" {
+		var err error
+		if tables, err = df.tables(*tableList); err != nil {
+			return err
+		}
+	}
+	db, err := df.open(false, tables...)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		tables = db.Tables()
+	}
+	for _, table := range tables {
+		var st simplewaldb.TableStats
+		st, err = db.Stats(table)
+		if err != nil {
+			break
+		}
+		fmt.Printf("%s: %d live keys, %d keys, %d records, %d data files "+
+			"(%d bytes), index %d bytes\n", table, st.LiveKeys, st.Keys,
+			st.Records, st.DataFiles, st.DataSize, st.IndexSize)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func runDump(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("dump", &df)
+	table := fs.String("table", "", "table to dump")
+	raw := fs.Bool("raw", false, "print values as is instead of hex-encoded")
+	fs.Parse(args)
+
+	return df.runTx(*table, false, func(tab *simplewaldb.TxTable) error {
+		for key, value := range tab.All() {
+			fmt.Printf("%x %s\n", key, formatValue(value, *raw))
+		}
+		return nil
+	})
+}
+
+func runVerify(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("verify", &df)
+	tableList := fs.String("tables", "", "comma-separated list of tables (default: all tables)")
+	prevSeps := fs.String("prev-sep", "", "comma-separated list of separators used before rotating the separator (hex)")
+	fs.Parse(args)
+
+	tables, err := df.tables(*tableList)
+	if err != nil {
+		return err
+	}
+	opts, err := df.options(tables...)
+	if err != nil {
+		return err
+	}
+	if *prevSeps != "" {
+		seps := strings.Split(*prevSeps, ",")
+		for _, sep := range seps {
+			if err := checkSeparator(sep); err != nil {
+				return err
+			}
+		}
+		opts = append(opts, simplewaldb.WithPreviousSeparatorsHex(seps...))
+	}
+	report, err := simplewaldb.Verify(df.rootDir, opts...)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		fmt.Printf("%s: %d records\n", table, report.Records[table])
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	if !report.OK() {
+		return fmt.Errorf("%w: %d", errIssuesFound, len(report.Issues))
+	}
+	return nil
+}
+
+func runUpgrade(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("upgrade", &df)
+	fs.Parse(args)
+
+	upgraded, err := simplewaldb.Upgrade(df.rootDir)
+	if err != nil {
+		return err
+	}
+	for _, table := range upgraded {
+		fmt.Printf("%s: upgraded\n", table)
+	}
+	return nil
+}
+
+func runRotate(args []string) error {
+	var df dbFlags
+	fs := newFlagSet("rotate", &df)
+	newSep := fs.String("new-sep", "", "new separator of the DB (hex)")
+	fs.Parse(args)
+
+	if err := checkSeparator(*newSep); err != nil {
+		return err
+	}
+	db, err := df.open(true)
+	if err != nil {
+		return err
+	}
+	err = db.RotateSeparator(*newSep)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
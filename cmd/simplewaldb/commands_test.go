@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+	"matheusd.com/simplewaldb"
+)
+
+// runCommand runs a command of the CLI with the given stdin and returns what
+// it wrote to stdout and its error.
+func runCommand(t *testing.T, stdin string, name string, args ...string) (string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	in, err := os.Create(filepath.Join(dir, "stdin"))
+	require.NoError(t, err)
+	defer in.Close()
+	_, err = in.WriteString(stdin)
+	require.NoError(t, err)
+	_, err = in.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	out, err := os.Create(filepath.Join(dir, "stdout"))
+	require.NoError(t, err)
+	defer out.Close()
+
+	origStdin, origStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = in, out
+	runErr := commands[name].run(args)
+	os.Stdin, os.Stdout = origStdin, origStdout
+
+	b, err := os.ReadFile(out.Name())
+	require.NoError(t, err)
+	return string(b), runErr
+}
+
+// createTestDB creates a DB with a single table named "test" in a new dir and
+// returns the dir.
+func createTestDB(t *testing.T) string {
+	t.Helper()
+	rootDir := t.TempDir()
+	db, err := simplewaldb.NewDB(simplewaldb.WithRootDir(rootDir),
+		simplewaldb.WithSeparatorHex(defaultSeparatorHex),
+		simplewaldb.WithTables("test"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	return rootDir
+}
+
+// TestPutGetDump tests that values written with the put command are read back
+// by the get and dump commands, both hex-encoded and raw.
+func TestPutGetDump(t *testing.T) {
+	rootDir := createTestDB(t)
+	key1 := strings.Repeat("01", simplewaldb.KeySize)
+	key2 := strings.Repeat("02", simplewaldb.KeySize)
+	key3 := strings.Repeat("03", simplewaldb.KeySize)
+	key4 := strings.Repeat("04", simplewaldb.KeySize)
+	common := []string{"-root", rootDir, "-table", "test"}
+	cmd := func(stdin string, name string, args ...string) string {
+		t.Helper()
+		out, err := runCommand(t, stdin, name, append(common, args...)...)
+		require.NoError(t, err)
+		return out
+	}
+
+	// Hex values, given as a flag and read from stdin (with a trailing line
+	// feed).
+	require.Empty(t, cmd("", "put", "-key", key1, "-value", "c0ffee"))
+	require.Empty(t, cmd("abcdef\n", "put", "-key", key2))
+	require.Equal(t, "c0ffee\n", cmd("", "get", "-key", key1))
+	require.Equal(t, "abcdef\n", cmd("", "get", "-key", key2))
+
+	// Raw values are written and read as is, including line feeds.
+	require.Empty(t, cmd("", "put", "-key", key3, "-raw", "-value", "flag value"))
+	require.Empty(t, cmd("stdin value\n", "put", "-key", key4, "-raw"))
+	require.Equal(t, "flag value", cmd("", "get", "-key", key3, "-raw"))
+	require.Equal(t, "stdin value\n", cmd("", "get", "-key", key4, "-raw"))
+	require.Equal(t, "666c61672076616c7565\n", cmd("", "get", "-key", key3))
+
+	require.Equal(t, key1+" c0ffee\n"+
+		key2+" abcdef\n"+
+		key3+" 666c61672076616c7565\n"+
+		key4+" 737464696e2076616c75650a\n",
+		cmd("", "dump"))
+	require.Equal(t, key1+" \xc0\xff\xee\n"+
+		key2+" \xab\xcd\xef\n"+
+		key3+" flag value\n"+
+		key4+" stdin value\n\n",
+		cmd("", "dump", "-raw"))
+}
+
+// TestCorruptedRecord tests that commands that iterate over a table fail when
+// the data of a record is corrupted, and that listing keys does not read their
+// values.
+func TestCorruptedRecord(t *testing.T) {
+	rootDir := createTestDB(t)
+	key1 := strings.Repeat("01", simplewaldb.KeySize)
+	key2 := strings.Repeat("02", simplewaldb.KeySize)
+	common := []string{"-root", rootDir, "-table", "test"}
+	for _, key := range []string{key1, key2} {
+		_, err := runCommand(t, "", "put", append(common, "-key", key, "-value", "c0ffee")...)
+		require.NoError(t, err)
+	}
+
+	// Corrupt the data of the first record, right after the header of the
+	// data file.
+	f, err := os.OpenFile(filepath.Join(rootDir, "test.data"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 18)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = runCommand(t, "", "dump", common...)
+	require.ErrorIs(t, err, simplewaldb.ErrChecksumMismatch{})
+	out, err := runCommand(t, "", "keys", common...)
+	require.NoError(t, err)
+	require.Equal(t, key1+"\n"+key2+"\n", out)
+}
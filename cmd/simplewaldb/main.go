@@ -0,0 +1,217 @@
+// Command simplewaldb provides tools to inspect, edit and maintain simplewaldb
+// databases.
+//
+// Usage:
+//
+//	simplewaldb <command> [flags]
+//
+// Run "simplewaldb <command> -h" for the flags of each command. Values are
+// read and written hex-encoded, unless the -raw flag is used.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"matheusd.com/simplewaldb"
+)
+
+// defaultSeparatorHex is the default separator of simplewaldb databases.
+const defaultSeparatorHex = "ce6dcbb021ea09d2c6e77714d7cdefcdf28fe1e0b4221e24d78648efe10ed8"
+
+// errIssuesFound is returned by commands that found issues in the DB, after
+// reporting them.
+var errIssuesFound = errors.New("issues found")
+
+// command is a subcommand of the CLI.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"tables":  {"list the tables of the DB", runTables},
+	"keys":    {"list the keys of a table", runKeys},
+	"get":     {"print the value of a key", runGet},
+	"put":     {"write the value of a key", runPut},
+	"history": {"print all versions of a key", runHistory},
+	"stats":   {"print statistics of tables", runStats},
+	"dump":    {"print all keys and values of a table", runDump},
+	"verify":  {"cross-check the index and data files of tables", runVerify},
+	"upgrade": {"rewrite index files in older formats in the current one", runUpgrade},
+	"rotate":  {"replace the separator of the DB with a new one", runRotate},
+}
+
+// dbFlags are the flags common to commands that access a DB.
+type dbFlags struct {
+	rootDir   string
+	separator string
+}
+
+// newFlagSet creates the flag set of a command, with the common DB flags.
+func newFlagSet(name string, df *dbFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&df.rootDir, "root", ".", "root dir of the DB")
+	fs.StringVar(&df.separator, "sep", defaultSeparatorHex, "separator of the DB (hex)")
+	return fs
+}
+
+// checkSeparator checks that a (hex) separator is valid.
+func checkSeparator(s string) error {
+	if _, err := hex.DecodeString(s); err != nil || len(s) != 62 {
+		return errors.New("separator must be 62 hex chars")
+	}
+	return nil
+}
+
+// options returns the DB options defined by the flags, for the given tables (or
+// all tables in the root dir, if none are given).
+func (df *dbFlags) options(tables ...simplewaldb.TableKey) ([]simplewaldb.Option, error) {
+	if err := checkSeparator(df.separator); err != nil {
+		return nil, err
+	}
+	opts := []simplewaldb.Option{
+		simplewaldb.WithRootDir(df.rootDir),
+		simplewaldb.WithSeparatorHex(df.separator),
+	}
+	if len(tables) > 0 {
+		opts = append(opts, simplewaldb.WithTables(tables...))
+	} else {
+		opts = append(opts, simplewaldb.WithDiscoverTables())
+	}
+	return opts, nil
+}
+
+// tables returns the given comma-separated list of tables, or all tables in
+// the root dir if the list is empty. Every table must exist.
+func (df *dbFlags) tables(list string) ([]simplewaldb.TableKey, error) {
+	existing, err := simplewaldb.ListTables(df.rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if list == "" {
+		if len(existing) == 0 {
+			return nil, fmt.Errorf("no tables found in %q", df.rootDir)
+		}
+		return existing, nil
+	}
+
+	var tables []simplewaldb.TableKey
+	for _, s := range strings.Split(list, ",") {
+		table := simplewaldb.TableKey(s)
+		if !slices.Contains(existing, table) {
+			return nil, fmt.Errorf("table %q does not exist", table)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// open the DB with the given (existing) tables, or all tables in the root dir if
+// none are given. Unless writable is true, the DB is opened in read-only mode
+// (which does not conflict with another process that has it open).
+func (df *dbFlags) open(writable bool, tables ...simplewaldb.TableKey) (*simplewaldb.DB, error) {
+	opts, err := df.options(tables...)
+	if err != nil {
+		return nil, err
+	}
+	if !writable {
+		opts = append(opts, simplewaldb.WithReadOnly())
+	}
+	return simplewaldb.NewDB(opts...)
+}
+
+// runTx opens the DB with a single table (which must exist) and runs f in a
+// transaction that can read (or also write, if writable is true) it.
+func (df *dbFlags) runTx(tableName string, writable bool, f func(tab *simplewaldb.TxTable) error) error {
+	if tableName == "" {
+		return errors.New("a table must be specified with -table")
+	}
+	tables, err := df.tables(tableName)
+	if err != nil {
+		return err
+	}
+	db, err := df.open(writable, tables...)
+	if err != nil {
+		return err
+	}
+
+	txOpt := simplewaldb.WithReadTables(tables...)
+	if writable {
+		txOpt = simplewaldb.WithWriteTables(tables...)
+	}
+	txc, err := db.PrepareTx(txOpt)
+	if err == nil {
+		err = txc.RunTx(func(tx simplewaldb.Tx) error {
+			tab, err := tx.Table(tables[0])
+			if err != nil {
+				return err
+			}
+			if err := f(&tab); err != nil {
+				return err
+			}
+
+			// Iterating over a table stops on read errors, which are
+			// recorded in the tx.
+			return tx.Err()
+		})
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// parseKey parses a hex-encoded key.
+func parseKey(s string) (simplewaldb.Key, error) {
+	var key simplewaldb.Key
+	if len(s) != simplewaldb.KeySize*2 {
+		return key, fmt.Errorf("key must be %d hex chars", simplewaldb.KeySize*2)
+	}
+	if _, err := hex.Decode(key[:], []byte(s)); err != nil {
+		return key, fmt.Errorf("invalid key: %v", err)
+	}
+	return key, nil
+}
+
+// formatValue formats a value for output: hex-encoded, or as is if raw is
+// true.
+func formatValue(v []byte, raw bool) string {
+	if raw {
+		return string(v)
+	}
+	return hex.EncodeToString(v)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].usage)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
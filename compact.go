@@ -0,0 +1,284 @@
+package simplewaldb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// archiveDirName is the name of the dir (inside the root dir) where files that
+// are no longer used by the DB are moved to.
+const archiveDirName = "archive"
+
+// newArchiveDir creates a new dir inside the archive dir to hold files of the
+// given table, named after the reason for archiving them and the current time.
+func newArchiveDir(rootDir string, tableName TableKey, reason string) (string, error) {
+	name := fmt.Sprintf("%s.%s.%s", tableName, reason,
+		time.Now().UTC().Format("20060102T150405.000000000Z"))
+	dir := filepath.Join(rootDir, archiveDirName, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// syncDir fsyncs a dir, making renames and file creations in it durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+type compactCfg struct {
+	keepVersions int
+}
+
+// CompactOption is an option for compacting a table.
+type CompactOption func(c *compactCfg)
+
+// WithKeepVersions defines how many of the most recent versions of each key
+// are kept when compacting a table. The default is 1 (only the current value of
+// each key is kept).
+func WithKeepVersions(n int) CompactOption {
+	return func(c *compactCfg) {
+		c.keepVersions = n
+	}
+}
+
+// compactionVersions returns the versions of the key that are kept by a
+// compaction, from the oldest to the most recent one.
+//
+// Versions whose data was punched are not kept, since copying them would turn
+// their zeroed data into regular values (and allocate their space again).
+func (tab *table) compactionVersions(key Key, keepVersions int) ([]indexRecord, error) {
+	var versions []indexRecord
+	var nbRanged int
+	err := tab.rangeRevEntries(key, func(ir indexRecord) error {
+		nbRanged++
+		punched, err := tab.isPunched(&ir)
+		if err != nil {
+			return err
+		}
+		if !punched {
+			versions = append(versions, ir)
+		}
+		if nbRanged >= keepVersions {
+			return errStopIter
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopIter) {
+		return nil, err
+	}
+
+	// Tombstones that are not preceded by any value do not need to be
+	// kept.
+	for len(versions) > 0 && versions[len(versions)-1].deleted {
+		versions = versions[:len(versions)-1]
+	}
+	slices.Reverse(versions)
+	return versions, nil
+}
+
+// compact copies the kept versions of every key into a new data file (which
+// may be rotated, as usual) and index, then replaces the table's files with
+// them. The old files are moved into the archive dir.
+//
+// The caller must hold the table's write lock.
+func (tab *table) compact(keepVersions int) error {
+	newDataFileNum := tab.curDataFile + 1
+	newDataPath := dataFilePath(tab.rootDir, tab.key, newDataFileNum)
+	newDataFile, err := createDataFile(newDataPath)
+	if err != nil {
+		return err
+	}
+
+	indexPath := filepath.Join(tab.rootDir, string(tab.key)+".index")
+	newIndexPath := indexPath + ".compact"
+	newIndexFile, err := os.OpenFile(newIndexPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		newDataFile.Close()
+		os.Remove(newDataPath)
+		return err
+	}
+
+	// The compacted table is written through a new table object that only
+	// has the new files.
+	out := &table{
+		key:         tab.key,
+		rootDir:     tab.rootDir,
+		dataFiles:   map[uint32]*os.File{newDataFileNum: newDataFile},
+		dataFile:    newDataFile,
+		curDataFile: newDataFileNum,
+		dataEnds:    map[uint32]int64{newDataFileNum: fileHeaderSize},
+		indexFile:   newIndexFile,
+		index:       make(map[Key]*indexRecord, len(tab.index)),
+		keys:        newKeysBTree(nil),
+		sepBuffer:   slices.Clone(tab.sepBuffer),
+		indexSize:   fileHeaderSize,
+		irw:         newIndexRecordWriter(indexRecordSize),
+		irSize:      indexRecordSize,
+		indexStart:  fileHeaderSize,
+		opts:        tab.opts,
+	}
+	fail := func(err error) error {
+		out.close()
+		for n := range out.dataFiles {
+			os.Remove(dataFilePath(tab.rootDir, tab.key, n))
+		}
+		os.Remove(newIndexPath)
+		return err
+	}
+
+	indexWriter := bufio.NewWriter(newIndexFile)
+	if _, err := indexWriter.Write(encodeFileHeader(indexFileMagic, indexFormatVersion)); err != nil {
+		return fail(err)
+	}
+	var data []byte
+	for key := range tab.allKeys() {
+		versions, err := tab.compactionVersions(key, keepVersions)
+		if err != nil {
+			return fail(err)
+		}
+
+		for _, ir := range versions {
+			data = slices.Grow(data[:0], int(ir.size))[:ir.size]
+			if n, err := tab.readEntry(&ir, data); err != nil {
+				return fail(err)
+			} else if n != len(data) {
+				return fail(fmt.Errorf("short read: read %d, expected %d", n, len(data)))
+			}
+
+			dataFile, offset, err := out.appendData(key, data, ir.deleted)
+			if err != nil {
+				return fail(err)
+			}
+			newIR := out.newRecord(key, dataFile, offset, data, ir.deleted, out.indexSize)
+			irBuf := out.irw.writeEntry(&newIR)
+			if _, err := indexWriter.Write(irBuf); err != nil {
+				return fail(err)
+			}
+			out.indexSize += int64(len(irBuf))
+			out.setEntry(newIR)
+		}
+	}
+	if err := indexWriter.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := out.dataFile.Sync(); err != nil {
+		return fail(fmt.Errorf("error fsyncing data table: %v", err))
+	}
+	if err := newIndexFile.Sync(); err != nil {
+		return fail(fmt.Errorf("error fsyncing index table: %v", err))
+	}
+
+	// Keep a copy of the old index in the archive, then atomically replace
+	// it with the new one.
+	archiveDir, err := newArchiveDir(tab.rootDir, tab.key, "compact")
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Link(indexPath, filepath.Join(archiveDir, filepath.Base(indexPath))); err != nil {
+		return fail(err)
+	}
+	if err := removeCheckpoint(tab.rootDir, tab.key); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(newIndexPath, indexPath); err != nil {
+		return fail(err)
+	}
+
+	// From this point on, the table is compacted (even if syncing the dir
+	// fails, the new index is the one that is in the root dir). Move the
+	// old data files into the archive.
+	syncErr := syncDir(tab.rootDir)
+	oldDataFiles := tab.dataFiles
+	tab.dataFiles = out.dataFiles
+	tab.dataFile = out.dataFile
+	tab.curDataFile = out.curDataFile
+	tab.dataEnds = out.dataEnds
+	tab.index = out.index
+	tab.keys = out.keys
+	tab.nbLive = out.nbLive
+	tab.indexSize = out.indexSize
+	tab.irw, tab.irSize, tab.indexStart = out.irw, out.irSize, out.indexStart
+	tab.checkpointOffset = out.indexStart
+	oldIndexFile := tab.indexFile
+	tab.indexFile = out.indexFile
+
+	firstErr := syncErr
+	if err := oldIndexFile.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	for n, f := range oldDataFiles {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		oldPath := dataFilePath(tab.rootDir, tab.key, n)
+		err := os.Rename(oldPath, filepath.Join(archiveDir, filepath.Base(oldPath)))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := syncDir(tab.rootDir); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// Compact rewrites the given table, keeping only the current value of each key
+// (or the last few versions, see WithKeepVersions) in a new data file and
+// index. Deleted keys are only kept if some of their kept versions are values.
+// Versions whose data was punched (see PunchDeadRecords) are not kept.
+//
+// The table's write lock is held while it is compacted. After the compaction,
+// the old index and data files are moved into a new dir inside the "archive"
+// dir of the root dir, where they may be inspected or deleted.
+//
+// Compacting fails if a committed transaction could not be applied to the
+// index files (until the DB is reopened and its WAL record is replayed).
+func (db *DB) Compact(tableKey TableKey, opts ...CompactOption) error {
+	cfg := &compactCfg{keepVersions: 1}
+	for _, o := range opts {
+		o(cfg)
+	}
+	if cfg.keepVersions < 1 {
+		return errors.New("at least one version must be kept")
+	}
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	tab, lock := db.tables[tableKey], db.locks[tableKey]
+	db.mu.Unlock()
+	if tab == nil || lock == nil {
+		return fmt.Errorf("table %q does not exist", tableKey)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if tab.dropped {
+		return ErrTableDropped(tableKey)
+	}
+
+	// A committed WAL record that was not applied refers to offsets in the
+	// current files of the table, so it must be replayed (by reopening the
+	// DB) before they are replaced.
+	if err := db.wal.stickyErr(); err != nil {
+		return err
+	}
+	return tab.compact(cfg.keepVersions)
+}
@@ -0,0 +1,241 @@
+package simplewaldb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestCompact tests compacting a table.
+func TestCompact(t *testing.T) {
+	const NBKEYS = 50
+	const NBVERSIONS = 5
+
+	tests := []struct {
+		name         string
+		keepVersions int
+	}{{
+		name:         "only live values",
+		keepVersions: 1,
+	}, {
+		name:         "last 3 versions",
+		keepVersions: 3,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tableName := TableKey("test")
+			rootDir := t.TempDir()
+			opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+			db, err := NewDB(opts...)
+			require.NoError(t, err)
+
+			value := func(k, v int) []byte {
+				return []byte{byte(k), byte(v), 0xaa}
+			}
+
+			// Write multiple versions of every key, deleting the
+			// last one.
+			txc := prepTestTx(t, db, WithWriteTables(tableName))
+			for v := range NBVERSIONS {
+				runTestTx(t, txc, func(tx Tx) error {
+					for k := range NBKEYS {
+						tx.Put(tableName, keyFromInt(k), value(k, v))
+					}
+					return tx.Err()
+				})
+			}
+			runTestTx(t, txc, func(tx Tx) error {
+				return tx.Delete(tableName, keyFromInt(NBKEYS-1)).Err()
+			})
+			oldDataFiles, err := listDataFiles(rootDir, tableName)
+			require.NoError(t, err)
+
+			require.NoError(t, db.Compact(tableName, WithKeepVersions(tc.keepVersions)))
+
+			// Old files are in the archive.
+			archived, err := filepath.Glob(filepath.Join(rootDir, archiveDirName, "*", "*"))
+			require.NoError(t, err)
+			require.Len(t, archived, len(oldDataFiles)+1)
+			newDataFiles, err := listDataFiles(rootDir, tableName)
+			require.NoError(t, err)
+			require.Len(t, newDataFiles, 1)
+			require.NotContains(t, oldDataFiles, newDataFiles[0])
+
+			check := func(db *DB) {
+				t.Helper()
+				txc := prepTestTx(t, db, WithReadTables(tableName))
+				runTestTx(t, txc, func(tx Tx) error {
+					tab := tx.MustTable(tableName)
+					count, err := tab.Count()
+					require.NoError(t, err)
+					require.Equal(t, NBKEYS-1, count)
+					for k := range NBKEYS - 1 {
+						key := keyFromInt(k)
+						require.Equal(t, value(k, NBVERSIONS-1), tx.Get(tableName, key))
+
+						var got [][]byte
+						for v, err := range tab.History(key) {
+							require.NoError(t, err)
+							got = append(got, v.Data)
+						}
+						want := make([][]byte, tc.keepVersions)
+						for i := range want {
+							want[i] = value(k, NBVERSIONS-1-i)
+						}
+						require.Equal(t, want, got)
+					}
+
+					deletedKey := keyFromInt(NBKEYS - 1)
+					require.False(t, tx.Exists(tableName, deletedKey))
+					var nbVersions int
+					for _, err := range tab.History(deletedKey) {
+						require.NoError(t, err)
+						nbVersions++
+					}
+					if tc.keepVersions == 1 {
+						// Only the tombstone would be kept.
+						require.Equal(t, 0, nbVersions)
+					} else {
+						require.Equal(t, tc.keepVersions, nbVersions)
+					}
+					return tx.Err()
+				})
+			}
+			check(db)
+
+			// Writing after compaction works.
+			runTestTx(t, txc, func(tx Tx) error {
+				return tx.Put(tableName, keyFromInt(NBKEYS), value(NBKEYS, 0)).Err()
+			})
+
+			// Reopen and check again.
+			require.NoError(t, db.Close())
+			db, err = NewDB(opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			txc = prepTestTx(t, db, WithWriteTables(tableName))
+			runTestTx(t, txc, func(tx Tx) error {
+				require.Equal(t, value(NBKEYS, 0), tx.Get(tableName, keyFromInt(NBKEYS)))
+				return tx.Delete(tableName, keyFromInt(NBKEYS)).Err()
+			})
+			check(db)
+
+			_, err = os.Stat(filepath.Join(rootDir, string(tableName)+".index.compact"))
+			require.ErrorIs(t, err, os.ErrNotExist)
+		})
+	}
+}
+
+// TestCompactUnappliedWAL tests that tables are not compacted while a committed
+// WAL record has not been applied, because it refers to the files that would be
+// replaced.
+func TestCompactUnappliedWAL(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, Key{1}, []byte("old")).Err()
+	})
+
+	// Simulate a failure to apply a committed WAL record.
+	tx, err := db.BeginTx(txc)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(tableName, Key{1}, []byte("new")).Err())
+	tab := db.tables[tableName]
+	indexData, err := tab.prepareCommit()
+	require.NoError(t, err)
+	require.NoError(t, tab.dataFile.Sync())
+	db.wal.mu.Lock()
+	require.NoError(t, db.wal.commit([]walTableEntry{{
+		table:       tableName,
+		indexOffset: tab.indexSize,
+		indexData:   indexData,
+	}}))
+	db.wal.err = fmt.Errorf("%w: test", errWALApply)
+	db.wal.mu.Unlock()
+	require.NoError(t, tx.Rollback())
+
+	require.ErrorIs(t, db.Compact(tableName), errWALApply)
+	require.NoError(t, db.Close())
+
+	// The record is replayed when reopening the DB, after which the table
+	// can be compacted.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Compact(tableName))
+	txc = prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		require.Equal(t, []byte("new"), tx.Get(tableName, Key{1}))
+		return tx.Err()
+	})
+	require.NoError(t, db.Close())
+	report, err := Verify(rootDir, opts...)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Issues)
+}
+
+// TestCompactPunched tests that versions whose data was punched are not kept by
+// compactions.
+func TestCompactPunched(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	updatedKey, deletedKey, keptKey := keyFromInt(1), keyFromInt(2), keyFromInt(3)
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.
+			Put(tableName, updatedKey, []byte("old")).
+			Put(tableName, deletedKey, []byte("old")).
+			Put(tableName, keptKey, []byte("old")).
+			Err()
+	})
+	tab := db.tables[tableName]
+	punched := []indexRecord{*tab.index[updatedKey], *tab.index[deletedKey]}
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.
+			Put(tableName, updatedKey, []byte("new")).
+			Delete(tableName, deletedKey).
+			Put(tableName, keptKey, []byte("new")).
+			Err()
+	})
+
+	// Zero the data of the first versions of updatedKey and deletedKey, as
+	// punching holes does.
+	f, err := os.OpenFile(dataFilePath(rootDir, tableName, 0), os.O_RDWR, 0)
+	require.NoError(t, err)
+	for _, ir := range punched {
+		_, err = f.WriteAt(make([]byte, ir.size), ir.offset)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	require.NoError(t, db.Compact(tableName, WithKeepVersions(3)))
+	history := func(tx Tx, key Key) []string {
+		tab := tx.MustTable(tableName)
+		var versions []string
+		for v, err := range tab.History(key) {
+			require.NoError(t, err)
+			versions = append(versions, string(v.Data))
+		}
+		return versions
+	}
+	runTestTx(t, prepTestTx(t, db, WithReadTables(tableName)), func(tx Tx) error {
+		require.Equal(t, []string{"new"}, history(tx, updatedKey))
+		require.Empty(t, history(tx, deletedKey))
+		require.Equal(t, []string{"new", "old"}, history(tx, keptKey))
+		return nil
+	})
+	stats, err := db.Stats(tableName)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), stats.Records)
+}
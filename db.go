@@ -1,26 +1,66 @@
 package simplewaldb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 )
 
 // DB is the main database object.
 type DB struct {
-	mu     sync.Mutex
-	closed bool
+	mu       sync.Mutex
+	closed   bool
+	readOnly bool
 
-	locks  map[TableKey]*sync.RWMutex
+	cfg *config
+
+	locks  map[TableKey]*tableLock
 	tables map[TableKey]*table
+
+	// manifest is the manifest of the DB. It is nil in read-only DBs
+	// without a manifest.
+	manifest *dbManifest
+
+	// backupMu is held (for reading) while backups are taken and (for
+	// writing) while punching holes in data files, which would zero data
+	// that backups captured but did not copy yet.
+	backupMu sync.RWMutex
+
+	// dropping are the tables being dropped. They are no longer in tables,
+	// but their files are still in the root dir.
+	dropping map[TableKey]struct{}
+
+	// rotating is set while the separator is being rotated. Tables cannot
+	// be created or dropped meanwhile.
+	rotating bool
+
+	wal *wal
+
+	// dirLock is the exclusive lock on the root dir.
+	dirLock *dirLock
+
+	// repairs are the repairs done to the tables when they were opened.
+	repairs []TableRepair
 }
 
 // NewDB creates or opens a new DB.
+//
+// The root dir has a manifest that records the separator and tables of the DB.
+// It is created when the DB is first opened (for writing) and checked every time
+// it is opened: opening fails if the separator is not the one in the manifest
+// (with ErrSeparatorMismatch) or if the files of a table in the manifest are
+// missing.
 func NewDB(opts ...Option) (*DB, error) {
 	cfg := defineOptions(opts...)
 
-	if stat, err := os.Stat(cfg.rootDir); err != nil && !errors.Is(err, os.ErrNotExist) {
+	if stat, err := os.Stat(cfg.rootDir); err != nil && (cfg.readOnly || !errors.Is(err, os.ErrNotExist)) {
 		return nil, err
 	} else if err != nil {
 		// err == ErrNotExist
@@ -33,30 +73,343 @@ func NewDB(opts ...Option) (*DB, error) {
 	}
 
 	db := &DB{
-		locks:  make(map[TableKey]*sync.RWMutex, len(cfg.tables)),
-		tables: make(map[TableKey]*table, len(cfg.tables)),
+		cfg:      cfg,
+		locks:    make(map[TableKey]*tableLock, len(cfg.tables)),
+		tables:   make(map[TableKey]*table, len(cfg.tables)),
+		dropping: make(map[TableKey]struct{}),
+		readOnly: cfg.readOnly,
+	}
+
+	// fail closes everything opened so far. Errors are ignored because
+	// NewDB is failing already.
+	fail := func(err error) (*DB, error) {
+		for _, tab := range db.tables {
+			_ = tab.close()
+		}
+		if db.wal != nil {
+			_ = db.wal.close()
+		}
+		if db.dirLock != nil {
+			_ = db.dirLock.unlock()
+		}
+		return nil, err
+	}
+
+	// Only a single DB object (across all processes) may write to the
+	// files of the root dir. Read-only DBs neither lock the root dir nor
+	// touch the WAL.
+	if !cfg.readOnly {
+		var err error
+		db.dirLock, err = lockRootDir(cfg.rootDir, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the manifest (if the DB has one) before modifying any files.
+	manifest, err := loadManifest(cfg.rootDir, cfg.separator)
+	if err == nil && manifest != nil {
+		err = manifest.checkTables(cfg.rootDir)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	// Replay the WAL before opening the tables, so that their indexes
+	// include any committed but not yet applied records.
+	if !cfg.readOnly {
+		db.wal, err = openWAL(cfg.rootDir)
+		if err != nil {
+			return fail(err)
+		}
 	}
 
 	// Init tables.
-	var tables []*table
-	for _, tableKey := range cfg.tables {
-		tab, err := newTable(cfg.rootDir, tableKey, cfg.separator)
+	tableKeys := cfg.tables
+	if cfg.discoverTables {
+		found, err := ListTables(cfg.rootDir)
 		if err != nil {
-			// Close previous tables.
-			for _, tab := range tables {
-				// Ignore error because we're leaving already.
-				_ = tab.close()
+			return fail(err)
+		}
+		tableKeys = slices.Clone(tableKeys)
+		for _, tableKey := range found {
+			if !slices.Contains(tableKeys, tableKey) {
+				tableKeys = append(tableKeys, tableKey)
 			}
-			return nil, err
 		}
-		tables = append(tables, tab)
+	}
+	for _, tableKey := range tableKeys {
+		tab, err := newTable(cfg.rootDir, tableKey, cfg.separator, cfg.tableOptions())
+		if err != nil {
+			return fail(err)
+		}
+		if !tab.repair.IsEmpty() {
+			db.repairs = append(db.repairs, tab.repair)
+		}
 		db.tables[tableKey] = tab
-		db.locks[tableKey] = new(sync.RWMutex)
+		db.locks[tableKey] = new(tableLock)
 	}
 
+	// Record the separator and the opened tables in the manifest.
+	if cfg.readOnly {
+		db.manifest = manifest
+		return db, nil
+	}
+	changed := manifest == nil
+	if manifest == nil {
+		manifest = newManifest(cfg.separator)
+	}
+	for _, tableKey := range tableKeys {
+		changed = manifest.addTable(tableKey) || changed
+	}
+	if changed {
+		if err := writeManifest(cfg.rootDir, manifest); err != nil {
+			return fail(err)
+		}
+	}
+	db.manifest = manifest
+
 	return db, nil
 }
 
+// ListTables returns the tables in the given root dir (i.e. the ones that have
+// an index file), sorted by name.
+func ListTables(rootDir string) ([]TableKey, error) {
+	matches, err := filepath.Glob(filepath.Join(rootDir, "*.index"))
+	if err != nil {
+		return nil, err
+	}
+	tables := make([]TableKey, 0, len(matches))
+	for _, m := range matches {
+		tables = append(tables, TableKey(strings.TrimSuffix(filepath.Base(m), ".index")))
+	}
+	slices.Sort(tables)
+	return tables, nil
+}
+
+// Tables returns the tables of the DB, sorted by name.
+func (db *DB) Tables() []TableKey {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return slices.Sorted(maps.Keys(db.tables))
+}
+
+// CreateTable creates a new table (or opens it, if its files already exist in
+// the root dir). Transactions prepared after this returns may use the table.
+func (db *DB) CreateTable(tableKey TableKey) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return errors.New("db is closed")
+	}
+	if _, ok := db.tables[tableKey]; ok {
+		return fmt.Errorf("table %q already exists", tableKey)
+	}
+	if _, ok := db.dropping[tableKey]; ok {
+		return fmt.Errorf("table %q is being dropped", tableKey)
+	}
+	if db.rotating {
+		return errors.New("the separator is being rotated")
+	}
+
+	tab, err := newTable(db.cfg.rootDir, tableKey, db.cfg.separator, db.cfg.tableOptions())
+	if err != nil {
+		return err
+	}
+	if manifest := db.manifest.clone(); manifest.addTable(tableKey) {
+		if err := writeManifest(db.cfg.rootDir, manifest); err != nil {
+			_ = tab.close()
+			return err
+		}
+		db.manifest = manifest
+	}
+	if !tab.repair.IsEmpty() {
+		db.repairs = append(db.repairs, tab.repair)
+	}
+	db.tables[tableKey] = tab
+	db.locks[tableKey] = new(tableLock)
+	return nil
+}
+
+// DropTable drops a table. Its files are not erased, but moved into a new
+// subdir of the archive dir (named after the table, with reason "drop").
+//
+// The table is removed from the DB immediately, therefore preparing new
+// transactions that use it fails. This then waits for the transactions that are
+// using the table to finish. Transactions that were prepared before the table
+// was dropped fail to begin with ErrTableDropped.
+func (db *DB) DropTable(tableKey TableKey) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return errors.New("db is closed")
+	}
+	tab, lock := db.tables[tableKey], db.locks[tableKey]
+	if tab == nil || lock == nil {
+		db.mu.Unlock()
+		return fmt.Errorf("table %q does not exist", tableKey)
+	}
+	if db.rotating {
+		db.mu.Unlock()
+		return errors.New("the separator is being rotated")
+	}
+
+	// The table is removed from the manifest before its files are archived,
+	// so that the manifest never refers to missing files.
+	manifest := db.manifest.clone()
+	manifest.removeTable(tableKey)
+	if err := writeManifest(db.cfg.rootDir, manifest); err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	db.manifest = manifest
+	delete(db.tables, tableKey)
+	delete(db.locks, tableKey)
+	db.dropping[tableKey] = struct{}{}
+	db.mu.Unlock()
+
+	defer func() {
+		db.mu.Lock()
+		delete(db.dropping, tableKey)
+		db.mu.Unlock()
+	}()
+
+	lock.Lock()
+	defer lock.Unlock()
+	tab.dropped = true
+	return tab.archiveFiles()
+}
+
+// RotateSeparator replaces the separator of the DB with a new one (which, like
+// the one given to WithSeparatorHex, SHOULD be a random, 31-byte hex string),
+// for example because the current one was leaked.
+//
+// Records that were already written are not rewritten: every table starts
+// writing to a new data file, and the manifest records the first data file of
+// each table written with the new separator. Every table in the root dir must
+// be open. Transactions in progress are waited for, and new ones are blocked
+// until the separator is rotated. Meanwhile, creating and dropping tables (and
+// rotating the separator again) fails.
+//
+// After this returns, the DB MUST be opened with the new separator. The
+// previous ones are needed to verify (see WithPreviousSeparatorsHex) or rebuild
+// (see RebuildIndex) tables with data files written before the rotation.
+func (db *DB) RotateSeparator(separatorHex string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	var sep recordSeparator
+	if err := sep.fromHex(separatorHex); err != nil {
+		return fmt.Errorf("invalid separator: %v", err)
+	}
+
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return errors.New("db is closed")
+	}
+	if db.rotating {
+		db.mu.Unlock()
+		return errors.New("the separator is being rotated")
+	}
+	hash := separatorHash(sep)
+	if hash == db.manifest.SeparatorHash || slices.ContainsFunc(db.manifest.Rotations,
+		func(r separatorRotation) bool { return r.PrevSeparatorHash == hash }) {
+		db.mu.Unlock()
+		return errors.New("separator was already used by the DB")
+	}
+
+	// Data files of tables that are not open could not be rotated.
+	existing, err := ListTables(db.cfg.rootDir)
+	if err != nil {
+		db.mu.Unlock()
+		return err
+	}
+	for _, tableKey := range existing {
+		_, open := db.tables[tableKey]
+		_, dropping := db.dropping[tableKey]
+		if !open && !dropping {
+			db.mu.Unlock()
+			return fmt.Errorf("table %q is not open", tableKey)
+		}
+	}
+
+	// The set of tables cannot change until the rotation is done, so the
+	// table locks can be taken without holding db.mu (which transactions
+	// holding table locks may need).
+	tableKeys := slices.Sorted(maps.Keys(db.tables))
+	tables := make([]*table, len(tableKeys))
+	locks := make([]*tableLock, len(tableKeys))
+	for i, tableKey := range tableKeys {
+		tables[i], locks[i] = db.tables[tableKey], db.locks[tableKey]
+	}
+	prevHash := db.manifest.SeparatorHash
+	db.rotating = true
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.rotating = false
+		db.mu.Unlock()
+	}()
+
+	// Lock in the same order as transactions do, to avoid deadlocks.
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	defer func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			locks[i].Unlock()
+		}
+	}()
+
+	// Start a new data file in every table, unless its current one does not
+	// have any records yet. Until the manifest is written, the new data
+	// files are still written with the current separator.
+	rotation := separatorRotation{
+		PrevSeparatorHash: prevHash,
+		DataFiles:         make(map[TableKey]uint32, len(tableKeys)),
+	}
+	for i, tableKey := range tableKeys {
+		tab := tables[i]
+		offset, err := tab.dataFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if offset > fileHeaderSize {
+			if err := tab.rotateDataFile(); err != nil {
+				return err
+			}
+		}
+		rotation.DataFiles[tableKey] = tab.curDataFile
+	}
+
+	db.mu.Lock()
+	manifest := db.manifest.clone()
+	manifest.SeparatorHash = hash
+	manifest.Rotations = append(manifest.Rotations, rotation)
+	err = writeManifest(db.cfg.rootDir, manifest)
+	if err == nil {
+		db.manifest = manifest
+		db.cfg.separator = sep
+	}
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, tab := range tables {
+		copy(tab.sepBuffer, sep[:])
+	}
+	return nil
+}
+
 // Close the DB. It cannot be used after this returns.
 //
 // This function is NOT safe for concurrent calls with other DB operations.
@@ -71,54 +424,213 @@ func (db *DB) Close() error {
 	var firstErr error
 	for _, tab := range db.tables {
 		err := tab.close()
-		if firstErr != nil {
+		if firstErr == nil {
 			firstErr = err
 		}
 	}
+	if db.readOnly {
+		return firstErr
+	}
+	if err := db.wal.close(); firstErr == nil {
+		firstErr = err
+	}
+	if err := db.dirLock.unlock(); firstErr == nil {
+		firstErr = err
+	}
 
 	return firstErr
 }
 
 // BeginTx begins a new prepared transaction.
 //
-// EndTx MUST be called, otherwise this may deadlock the database.
+// This waits for the locks of all tables of the transaction (see BeginTxContext
+// to give up waiting). One of tx.Commit(), tx.Rollback() or EndTx MUST be
+// called, otherwise this may deadlock the database.
 func (db *DB) BeginTx(cfg *TxConfig) (Tx, error) {
+	return db.BeginTxContext(context.Background(), cfg)
+}
+
+// BeginTxContext is like BeginTx, but gives up waiting for the locks of the
+// tables of the transaction when ctx is done. In that case, the locks acquired
+// so far are released (in reverse order) and ctx.Err() is returned. Once the
+// transaction has begun, ctx is not used.
+//
+// While a transaction waits to write a table, new readers of the table are
+// blocked (so that writers are not starved by readers that continuously
+// overlap). Giving up withdraws the request entirely, unblocking them.
+func (db *DB) BeginTxContext(ctx context.Context, cfg *TxConfig) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return Tx{}, err
+	}
+
 	// Acquire all locks.
-	tx := Tx{cfg: cfg}
+	tx := Tx{cfg: cfg, err: new(error)}
 	// log.Printf("%p locking %v", tx.cfg, len(cfg.tables))
-	for _, tc := range cfg.lockOrder {
+	for i, tc := range cfg.lockOrder {
 		// log.Printf("%p locking   %s %v", tx.cfg, tc.key, tc.writable)
-		if tc.writable {
-			tc.lock.Lock()
-		} else {
-			tc.lock.RLock()
+		if err := tc.acquireContext(ctx); err != nil {
+			unlockTables(cfg.lockOrder[:i])
+			return Tx{}, err
 		}
 	}
 	// log.Printf("%p locked  %v", tx.cfg, len(cfg.tables))
 
+	// Tables may have been dropped after the tx was prepared.
+	for _, tc := range cfg.lockOrder {
+		if tc.table.dropped {
+			unlockTables(cfg.lockOrder)
+			return Tx{}, ErrTableDropped(tc.key)
+		}
+	}
+
 	return tx, nil
 }
 
-// EndTx finishes the transaction and releases all table locks.
+// unlockTables releases the locks of the tables (which must all be held) in
+// reverse order.
+func unlockTables(lockOrder []*txTableCfg) {
+	for i := len(lockOrder) - 1; i >= 0; i-- {
+		tc := lockOrder[i]
+		// log.Printf("%p unlocking %s %v", tx.cfg, tc.key, tc.writable)
+		tc.release()
+	}
+}
+
+// commitTx commits the writes staged by the transaction through the WAL.
 //
-// This MUST be called, otherwise the database may deadlock.
+// Data for all records is written and synced first, then the index records of
+// all tables are written as a single WAL record. Only after the WAL record is
+// durable are the index records written to the individual index files.
+func (db *DB) commitTx(tx *Tx) error {
+	var nbPending int
+	for _, tc := range tx.cfg.lockOrder {
+		if tc.writable && tc.table.hasPending() {
+			nbPending++
+		}
+	}
+	if nbPending == 0 {
+		return nil
+	}
+	if err := db.wal.stickyErr(); err != nil {
+		return err
+	}
+
+	// If the commit fails before the WAL record is written, the data
+	// appended so far is discarded, so that it does not end up in the middle
+	// of the data files (where it would be found by RebuildIndex). If that
+	// fails too, further commits are refused until the DB is reopened (which
+	// quarantines the data).
+	entries := make([]walTableEntry, 0, nbPending)
+	prepared := make([]*table, 0, nbPending)
+	abort := func(err error) error {
+		for _, tab := range prepared {
+			if truncErr := tab.truncatePrepared(); truncErr != nil {
+				db.wal.mu.Lock()
+				db.wal.err = fmt.Errorf("unable to discard the data of "+
+					"a failed commit; reopen the DB: %v", truncErr)
+				db.wal.mu.Unlock()
+				break
+			}
+		}
+		return err
+	}
+	for _, tc := range tx.cfg.lockOrder {
+		if !tc.writable || !tc.table.hasPending() {
+			continue
+		}
+		prepared = append(prepared, tc.table)
+		indexData, err := tc.table.prepareCommit()
+		if err != nil {
+			return abort(err)
+		}
+		if err := tc.table.dataFile.Sync(); err != nil {
+			return abort(fmt.Errorf("error fsyncing data table: %v", err))
+		}
+		entries = append(entries, walTableEntry{
+			table:       tc.key,
+			indexOffset: tc.table.indexSize,
+			indexData:   indexData,
+		})
+	}
+
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+	if err := db.wal.commit(entries); err != nil {
+		return err
+	}
+
+	// The transaction is now committed. Apply it to the index files.
+	for _, tc := range tx.cfg.lockOrder {
+		if !tc.writable || !tc.table.hasPending() {
+			continue
+		}
+		if err := tc.table.applyCommit(); err != nil {
+			db.wal.err = fmt.Errorf("%w: %v", errWALApply, err)
+			return db.wal.err
+		}
+	}
+	if err := db.wal.clear(); err != nil {
+		db.wal.err = fmt.Errorf("%w: %v", errWALApply, err)
+		return db.wal.err
+	}
+	return nil
+}
+
+// EndTx commits the transaction and releases all table locks. This is the same
+// as calling tx.Commit().
+//
+// This MUST be called (or one of Commit or Rollback), otherwise the database
+// may deadlock.
 func (db *DB) EndTx(tx *Tx) error {
+	return db.endTx(tx, true)
+}
+
+// endTx finishes the transaction, either committing or discarding its pending
+// writes, and releases all table locks.
+func (db *DB) endTx(tx *Tx, commit bool) error {
 	if tx.done {
 		return fmt.Errorf("transaction was already done")
 	}
 
-	// Release all locks in reverse order.
-	// log.Printf("%p releas  %v", tx.cfg, len(tx.cfg.tables))
-	for i := len(tx.cfg.lockOrder) - 1; i >= 0; i-- {
-		tc := tx.cfg.lockOrder[i]
-		// log.Printf("%p unlocking %s %v", tx.cfg, tc.key, tc.writable)
-		if tc.writable {
-			tc.lock.Unlock()
-		} else {
-			tc.lock.RUnlock()
+	var commitErr error
+	if commit {
+		commitErr = db.commitTx(tx)
+	}
+
+	// Discard any writes that were not committed, and checkpoint the
+	// tables that were written to (if needed).
+	for _, tc := range tx.cfg.lockOrder {
+		if !tc.writable {
+			continue
+		}
+		tc.table.discardPending()
+		if commit && commitErr == nil {
+			tc.table.maybeCheckpoint()
 		}
 	}
+
+	// Release all locks in reverse order.
+	// log.Printf("%p releas  %v", tx.cfg, len(tx.cfg.tables))
+	unlockTables(tx.cfg.lockOrder)
 	// log.Printf("%p done    %v", tx.cfg, len(tx.cfg.tables))
 	tx.done = true
-	return nil
+	return commitErr
+}
+
+// Stats returns the statistics of the given table. The table's read lock is
+// held while they are collected.
+func (db *DB) Stats(tableKey TableKey) (TableStats, error) {
+	db.mu.Lock()
+	tab, lock := db.tables[tableKey], db.locks[tableKey]
+	db.mu.Unlock()
+	if tab == nil || lock == nil {
+		return TableStats{}, fmt.Errorf("table %q does not exist", tableKey)
+	}
+
+	lock.RLock()
+	defer lock.RUnlock()
+	if tab.dropped {
+		return TableStats{}, ErrTableDropped(tableKey)
+	}
+	return tab.stats()
 }
@@ -8,7 +8,9 @@ import (
 	"maps"
 	"math/rand/v2"
 	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -279,3 +281,150 @@ func BenchmarkDBPut(b *testing.B) {
 		})
 	}
 }
+
+// TestStatsAndListTables tests the statistics of tables and listing the tables
+// of a root dir.
+func TestStatsAndListTables(t *testing.T) {
+	tableNames := []TableKey{"test2", "test1"}
+	db := newTestDB(t, WithTables(tableNames...), WithMaxDataFileSize(1000))
+	tableName := tableNames[0]
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	tables, err := ListTables(db.tables[tableName].rootDir)
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{"test1", "test2"}, tables)
+
+	st, err := db.Stats(tableName)
+	require.NoError(t, err)
+	require.Equal(t, TableStats{DataFiles: 1, DataSize: fileHeaderSize, IndexSize: fileHeaderSize}, st)
+
+	const NBKEYS = 10
+	value := make([]byte, 200)
+	for range 2 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range NBKEYS {
+				tx.Put(tableName, keyFromInt(k), value)
+			}
+			return tx.Err()
+		})
+	}
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Delete(tableName, keyFromInt(0)).Err()
+	})
+
+	st, err = db.Stats(tableName)
+	require.NoError(t, err)
+	require.Equal(t, NBKEYS-1, st.LiveKeys)
+	require.Equal(t, NBKEYS, st.Keys)
+	require.Equal(t, int64(NBKEYS*2+1), st.Records)
+	require.Equal(t, int64(NBKEYS*2+1)*indexRecordSize+fileHeaderSize, st.IndexSize)
+	require.Greater(t, st.DataFiles, 1)
+	require.Equal(t, int64(NBKEYS*2)*int64(len(value)+recordTrailerSize)+recordTrailerSize+
+		int64(st.DataFiles)*fileHeaderSize, st.DataSize)
+
+	_, err = db.Stats("missing")
+	require.Error(t, err)
+}
+
+// TestCreateDropTable tests creating and dropping tables while the DB is open.
+func TestCreateDropTable(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t)
+	rootDir := db.cfg.rootDir
+	key := keyFromInt(1)
+
+	_, err := db.PrepareTx(WithWriteTables(tableName))
+	require.Error(t, err)
+	require.Error(t, db.DropTable(tableName))
+
+	// Create the table and write to it.
+	require.NoError(t, db.CreateTable(tableName))
+	require.Error(t, db.CreateTable(tableName))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, key, []byte("old")).Err()
+	})
+	tables, err := ListTables(rootDir)
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{tableName}, tables)
+
+	// Dropping waits for the transactions that use the table.
+	tx, err := db.BeginTx(txc)
+	require.NoError(t, err)
+	dropErr := make(chan error, 1)
+	go func() { dropErr <- db.DropTable(tableName) }()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-dropErr:
+		t.Fatalf("table dropped while in use: %v", err)
+	default:
+	}
+	require.NoError(t, tx.Put(tableName, key, []byte("new")).Err())
+	require.NoError(t, tx.Commit())
+	require.NoError(t, <-dropErr)
+
+	// The files were archived.
+	tables, err = ListTables(rootDir)
+	require.NoError(t, err)
+	require.Empty(t, tables)
+	entries, err := os.ReadDir(filepath.Join(rootDir, archiveDirName))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, strings.HasPrefix(entries[0].Name(), string(tableName)+".drop."))
+	archived, err := os.ReadDir(filepath.Join(rootDir, archiveDirName, entries[0].Name()))
+	require.NoError(t, err)
+	require.Len(t, archived, 2) // Index and data file.
+
+	// Transactions prepared before dropping the table fail to begin, even
+	// after the table is created again.
+	_, err = db.BeginTx(txc)
+	require.ErrorIs(t, err, ErrTableDropped(tableName))
+	_, err = db.Stats(tableName)
+	require.Error(t, err)
+	require.NoError(t, db.CreateTable(tableName))
+	err = txc.RunTx(func(tx Tx) error { return nil })
+	require.ErrorIs(t, err, ErrTableDropped(tableName))
+
+	// The created table is empty.
+	txc = prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		require.False(t, tx.Exists(tableName, key))
+		return nil
+	})
+}
+
+// TestDiscoverTables tests opening all tables found in the root dir.
+func TestDiscoverTables(t *testing.T) {
+	rootDir := t.TempDir()
+	db, err := NewDB(WithRootDir(rootDir), WithTables("test2", "test1"))
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{"test1", "test2"}, db.Tables())
+	txc := prepTestTx(t, db, WithWriteTables("test1"))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put("test1", keyFromInt(1), []byte("value")).Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Only the listed tables are opened without discovery.
+	db, err = NewDB(WithRootDir(rootDir), WithTables("test2"))
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{"test2"}, db.Tables())
+	require.NoError(t, db.Close())
+
+	// Discovered tables are opened in addition to the listed ones.
+	db, err = NewDB(WithRootDir(rootDir), WithTables("test3"), WithDiscoverTables())
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{"test1", "test2", "test3"}, db.Tables())
+	txc = prepTestTx(t, db, WithReadTables("test1"))
+	runTestTx(t, txc, func(tx Tx) error {
+		require.Equal(t, []byte("value"), tx.Get("test1", keyFromInt(1)))
+		return tx.Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Discovery also works in read-only mode.
+	db, err = NewDB(WithRootDir(rootDir), WithDiscoverTables(), WithReadOnly())
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{"test1", "test2", "test3"}, db.Tables())
+	require.NoError(t, db.Close())
+}
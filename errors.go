@@ -8,6 +8,18 @@ import (
 // ErrTxDone is returned when a transaction has already completed.
 var ErrTxDone = errors.New("transaction is done")
 
+// ErrReadOnly is returned when attempting to write to a read-only DB.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ErrSeparatorMismatch is returned when opening a DB with a separator that does
+// not match the one recorded in its manifest (i.e. the one it was written
+// with).
+var ErrSeparatorMismatch = errors.New("separator does not match the one the DB was written with")
+
+// ErrPunchHoleNotSupported is returned when punching holes in data files is not
+// supported in the current platform.
+var ErrPunchHoleNotSupported = errors.New("punching holes is not supported in this platform")
+
 // ErrTableNotInTx is returned when a table does not exist in the database.
 type ErrTableNotInTx TableKey
 
@@ -28,6 +40,19 @@ func (err ErrTableNotWritableInTx) Error() string {
 	return fmt.Sprintf("table %q not writable in tx", string(err))
 }
 
+// ErrTableDropped is returned when using a table that was dropped (for example,
+// when beginning a transaction that was prepared before the table was dropped).
+type ErrTableDropped TableKey
+
+func (err ErrTableDropped) Error() string {
+	return fmt.Sprintf("table %q was dropped", string(err))
+}
+
+func (err ErrTableDropped) Is(target error) bool {
+	_, ok := target.(ErrTableDropped)
+	return ok
+}
+
 // ErrKeyNotFound is returned when a key is not found.
 type ErrKeyNotFound Key
 
@@ -39,3 +64,108 @@ func (err ErrKeyNotFound) Is(target error) bool {
 	_, ok := target.(ErrKeyNotFound)
 	return ok
 }
+
+// ErrChecksumMismatch is returned when the data of a record does not match the
+// checksum in its index record (i.e. the data file is corrupted).
+type ErrChecksumMismatch struct {
+	Key      Key
+	DataFile uint32
+	Offset   int64
+}
+
+func (err ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for key %x (data file %d, offset %d)",
+		err.Key[:], err.DataFile, err.Offset)
+}
+
+func (err ErrChecksumMismatch) Is(target error) bool {
+	_, ok := target.(ErrChecksumMismatch)
+	return ok
+}
+
+// ErrSeparatorCollision is returned when writing a value that contains the
+// separator, when separator collision checks are enabled (see
+// WithSeparatorCollisionCheck).
+type ErrSeparatorCollision struct {
+	Table TableKey
+	Key   Key
+}
+
+func (err ErrSeparatorCollision) Error() string {
+	return fmt.Sprintf("value of key %x of table %q contains the separator",
+		err.Key[:], err.Table)
+}
+
+func (err ErrSeparatorCollision) Is(target error) bool {
+	_, ok := target.(ErrSeparatorCollision)
+	return ok
+}
+
+// ErrUnsupportedFormat is returned when a file has a format version that is not
+// supported (i.e. it was written by a newer version of this package).
+type ErrUnsupportedFormat struct {
+	File    string
+	Version uint32
+}
+
+func (err ErrUnsupportedFormat) Error() string {
+	return fmt.Sprintf("file %q has unsupported format version %d", err.File, err.Version)
+}
+
+func (err ErrUnsupportedFormat) Is(target error) bool {
+	_, ok := target.(ErrUnsupportedFormat)
+	return ok
+}
+
+// ErrUpgradeRequired is returned when opening a table whose index file is in a
+// format that can only be used after upgrading it (see Upgrade).
+type ErrUpgradeRequired struct {
+	File string
+}
+
+func (err ErrUpgradeRequired) Error() string {
+	return fmt.Sprintf("file %q is in an old format and must be upgraded", err.File)
+}
+
+func (err ErrUpgradeRequired) Is(target error) bool {
+	_, ok := target.(ErrUpgradeRequired)
+	return ok
+}
+
+// ErrMissingSeparator is returned when the separator that a data file was
+// written with (before the separator of the DB was rotated) is needed, but it
+// was not given (see WithPreviousSeparatorsHex).
+type ErrMissingSeparator struct {
+	Table    TableKey
+	DataFile uint32
+}
+
+func (err ErrMissingSeparator) Error() string {
+	return fmt.Sprintf("separator of data file %d of table %q is not known "+
+		"(it was written before the separator was rotated)", err.DataFile, err.Table)
+}
+
+func (err ErrMissingSeparator) Is(target error) bool {
+	_, ok := target.(ErrMissingSeparator)
+	return ok
+}
+
+// ErrDBLocked is returned when the root dir of the DB is locked by another
+// process (or by another DB object of the same process).
+type ErrDBLocked struct {
+	// PID is the ID of the process that holds the lock, or zero if it is not
+	// known.
+	PID int
+}
+
+func (err ErrDBLocked) Error() string {
+	if err.PID == 0 {
+		return "database is locked by another process"
+	}
+	return fmt.Sprintf("database is locked by process %d", err.PID)
+}
+
+func (err ErrDBLocked) Is(target error) bool {
+	_, ok := target.(ErrDBLocked)
+	return ok
+}
@@ -3,6 +3,7 @@ module matheusd.com/simplewaldb
 go 1.23.0
 
 require (
+	github.com/google/btree v1.1.3
 	golang.org/x/sync v0.14.0
 	matheusd.com/depvendoredtestify v1.10.0-alpha
 )
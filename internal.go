@@ -1,10 +1,15 @@
 package simplewaldb
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
 )
 
 const recordSeparatorSize = 64
@@ -29,18 +34,259 @@ func (rs *recordSeparator) fromHex(s string) error {
 	return nil
 }
 
-// indexRecordSize is the size of an index record. An index record is:
+// separatorFromV1 decodes a record separator as written in data files before
+// v0.4.0 (i.e. in version 1 data files): a line feed, the 31 bytes of the
+// separator (instead of their hex encoding), 31 zero bytes and a line feed. It
+// returns false if b does not start with one.
+func separatorFromV1(b []byte) (recordSeparator, bool) {
+	const binSize = (recordSeparatorSize - 2) / 2
+	var rs recordSeparator
+	if len(b) < recordSeparatorSize || b[0] != lfChar || b[recordSeparatorSize-1] != lfChar ||
+		!isZeroed(b[1+binSize:recordSeparatorSize-1]) {
+		return rs, false
+	}
+	rs[0] = lfChar
+	hex.Encode(rs[1:], b[1:1+binSize])
+	rs[len(rs)-1] = lfChar
+	return rs, true
+}
+
+// fileHeaderSize is the size of the header at the start of index and data
+// files, which identifies the kind of file and the version of its format. The
+// header is:
+// 8 bytes magic
+// 1 byte space
+// 8 bytes hex-encoded format version
+// 1 byte line feed
+//
+// Files written before headers were added do not have one. Their format is
+// determined by their contents.
+const fileHeaderSize = 8 + 1 + 4*2 + 1
+
+// indexFileMagic and dataFileMagic are the magic strings of the headers of
+// index and data files.
+var (
+	indexFileMagic = [8]byte{'s', 'w', 'd', 'b', 'i', 'n', 'd', 'x'}
+	dataFileMagic  = [8]byte{'s', 'w', 'd', 'b', 'd', 'a', 't', 'a'}
+)
+
+const (
+	// indexFormatV1 is the format of index files written before v0.4.0,
+	// which do not have a header and have records without the previous
+	// index offset. These must be upgraded (see Upgrade) to be used.
+	indexFormatV1 = 1
+
+	// indexFormatV2 is the format of index files written by v0.4.0, which
+	// do not have a header and have records without checksums.
+	indexFormatV2 = 2
+
+	// indexFormatV3 is the format of index files with a header and
+	// records with checksums.
+	indexFormatV3 = 3
+
+	// indexFormatVersion is the format of new index files.
+	indexFormatVersion = indexFormatV3
+)
+
+// dataFormatVersion is the format of new data files. Data files without a
+// header are either of version 1 (written before v0.4.0, with a binary record
+// separator, see separatorFromV1) or 2 (with a hex-encoded separator). Only
+// the separator and header differ between versions, and both separators have
+// the same size, so Upgrade converts the separators of version 1 files in
+// place (which makes them version 2 files).
+const dataFormatVersion = 2
+
+// encodeFileHeader encodes the header of a file.
+func encodeFileHeader(magic [8]byte, version uint32) []byte {
+	b := make([]byte, 0, fileHeaderSize)
+	b = append(b, magic[:]...)
+	b = append(b, spaceChar)
+	b = hex.AppendEncode(b, binary.BigEndian.AppendUint32(nil, version))
+	return append(b, lfChar)
+}
+
+// decodeFileHeader decodes the header at the start of a file (given its first
+// bytes). It returns false if the file does not start with a header with the
+// given magic.
+func decodeFileHeader(head []byte, magic [8]byte) (uint32, bool, error) {
+	if len(head) < len(magic) || [8]byte(head[:8]) != magic {
+		return 0, false, nil
+	}
+	if len(head) < fileHeaderSize {
+		return 0, true, errors.New("file header is truncated")
+	}
+	var aux [4]byte
+	if head[8] != spaceChar || head[fileHeaderSize-1] != lfChar {
+		return 0, true, errors.New("file header is malformed")
+	}
+	if _, err := hex.Decode(aux[:], head[9:fileHeaderSize-1]); err != nil {
+		return 0, true, fmt.Errorf("wrong format version: %v", err)
+	}
+	return binary.BigEndian.Uint32(aux[:]), true, nil
+}
+
+// readFileHead reads the first bytes of a file, up to size.
+func readFileHead(f *os.File, size int) ([]byte, error) {
+	head := make([]byte, size)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// initFile writes the header to a file if it is empty. The file must be at its
+// start, and is left after the header.
+func initFile(f *os.File, magic [8]byte, version uint32) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() > 0 {
+		return nil
+	}
+	_, err = f.Write(encodeFileHeader(magic, version))
+	return err
+}
+
+// indexRecordSizeV1 is the size of an index record in the format written
+// before v0.4.0, which is the same as the one of indexRecordSizeV2 without the
+// previous index offset (and its preceding space).
+const indexRecordSizeV1 = indexRecordSizeV2 - 1 - 8*2
+
+// indexRecordSizeV2 is the size of an index record without a checksum (as
+// written before checksums were added). Such an index record is:
 // 8 bytes hex-encoded data file index
 // 1 byte space
 // 16 bytes hex-encoded offset
 // 1 byte space
-// 16 bytes hex-encoded size
+// 16 bytes hex-encoded size (all f's for tombstones)
 // 1 byte space
 // 32 bytes hex-encoded key
 // 1 byte space
 // 16 bytes hex-encoded previous index offset
 // 1 byte line feed
-const indexRecordSize = 4*2 + 1 + 8*2 + 1 + 8*2 + 1 + KeySize*2 + 1 + 8*2 + 1
+const indexRecordSizeV2 = 4*2 + 1 + 8*2 + 1 + 8*2 + 1 + KeySize*2 + 1 + 8*2 + 1
+
+// indexRecordSize is the size of an index record in the current format. It is
+// the same as the previous one, with the following before the line feed:
+// 1 byte space
+// 8 bytes hex-encoded CRC32 (Castagnoli) of the record's data
+//
+// All records of an index file have the same format. New index files are
+// written in the current format, while existing ones keep their format until
+// they are rewritten (for example, by a compaction or Upgrade).
+const indexRecordSize = indexRecordSizeV2 + 1 + 4*2
+
+// crc32cTable is the table for CRC32 (Castagnoli) checksums.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// indexFormat is the format of an index file.
+type indexFormat struct {
+	version uint32
+
+	// start is the offset of the first record (i.e. the size of the
+	// header, if the file has one).
+	start int64
+
+	// recordSize is the size of every record.
+	recordSize int64
+}
+
+// detectIndexFormat returns the format of an index file, given its first bytes.
+// Files without a header are identified by the position of the first line
+// feed. Empty files use the current format (their header is written when they
+// are initialized).
+func detectIndexFormat(head []byte) (indexFormat, error) {
+	if len(head) == 0 {
+		return indexFormat{indexFormatVersion, fileHeaderSize, indexRecordSize}, nil
+	}
+
+	version, ok, err := decodeFileHeader(head, indexFileMagic)
+	switch {
+	case err != nil:
+		return indexFormat{}, err
+	case !ok && len(head) >= indexRecordSizeV1 && head[indexRecordSizeV1-1] == lfChar:
+		return indexFormat{indexFormatV1, 0, indexRecordSizeV1}, nil
+	case !ok:
+		return indexFormat{indexFormatV2, 0, indexRecordSizeV2}, nil
+	case version == indexFormatV3:
+		return indexFormat{indexFormatV3, fileHeaderSize, indexRecordSize}, nil
+	default:
+		return indexFormat{}, ErrUnsupportedFormat{Version: version}
+	}
+}
+
+// readIndexFormat returns the format of an index file.
+func readIndexFormat(f *os.File) (indexFormat, error) {
+	head, err := readFileHead(f, fileHeaderSize+indexRecordSize)
+	if err != nil {
+		return indexFormat{}, err
+	}
+	format, err := detectIndexFormat(head)
+	var unsupported ErrUnsupportedFormat
+	if errors.As(err, &unsupported) {
+		unsupported.File = f.Name()
+		return format, unsupported
+	}
+	if err != nil {
+		return format, fmt.Errorf("index file %q: %v", f.Name(), err)
+	}
+	return format, nil
+}
+
+// readDataFileStart returns the offset of the first record of a data file
+// (i.e. the size of its header, if it has one).
+func readDataFileStart(f *os.File) (int64, error) {
+	head, err := readFileHead(f, fileHeaderSize)
+	if err != nil {
+		return 0, err
+	}
+	version, ok, err := decodeFileHeader(head, dataFileMagic)
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("data file %q: %v", f.Name(), err)
+	case !ok:
+		return 0, nil
+	case version != dataFormatVersion:
+		return 0, ErrUnsupportedFormat{File: f.Name(), Version: version}
+	default:
+		return fileHeaderSize, nil
+	}
+}
+
+// checksumMatches returns true if data matches the checksum of a record. If
+// the record is dead (i.e. it is not the current value of a live key), data
+// that is entirely zeroed also matches, because that is what is read from
+// records whose data was punched (see DB.PunchDeadRecords).
+func checksumMatches(data []byte, checksum uint32, dead bool) bool {
+	if crc32.Checksum(data, crc32cTable) == checksum {
+		return true
+	}
+	return dead && isZeroed(data)
+}
+
+// isZeroed returns true if every byte of data is zero.
+func isZeroed(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// tombstoneSize is the size encoded in index records of tombstones (i.e.
+// records that mark a key as deleted).
+const tombstoneSize = -1
+
+// recordPaddingSize is the size of the padding written after the hex-encoded
+// key that follows every record separator in the data file.
+const recordPaddingSize = 8
+
+// tombstoneMarker is written as the padding after the key of tombstone records
+// in the data file. Other records are padded with line feeds.
+const tombstoneMarker = "DELETED\n"
 
 // indexRecord is an entry in the index.
 type indexRecord struct {
@@ -50,16 +296,31 @@ type indexRecord struct {
 	key             Key
 	prevIndexOffset int64
 	indexOffset     int64
+
+	// deleted is true for tombstone records. The size of tombstones is
+	// always zero.
+	deleted bool
+
+	// checksum is the checksum of the record's data. Records of index
+	// files in the format without checksums do not have one.
+	checksum    uint32
+	hasChecksum bool
 }
 
 const spaceChar = byte(' ')
 const lfChar = byte('\n')
 
-// decode the entry from a buffer.
+// decode the entry from a buffer, in any of the index formats (determined by
+// the size of the buffer). Records in the format written before v0.4.0 do not
+// have a previous index offset, so it is set to math.MaxInt64 (i.e. no previous
+// version).
 func (ir *indexRecord) decode(b []byte) error {
-	if len(b) != indexRecordSize {
+	if len(b) != indexRecordSize && len(b) != indexRecordSizeV2 && len(b) != indexRecordSizeV1 {
 		return errors.New("index entry is wrong")
 	}
+	if b[len(b)-1] != lfChar {
+		return errors.New("index entry does not end with a line feed")
+	}
 
 	var auxArr [8]byte
 	aux := auxArr[:]
@@ -83,6 +344,10 @@ func (ir *indexRecord) decode(b []byte) error {
 		return fmt.Errorf("wrong size: %v", err)
 	}
 	ir.size = int64(binary.BigEndian.Uint64(aux))
+	ir.deleted = ir.size == tombstoneSize
+	if ir.deleted {
+		ir.size = 0
+	}
 
 	b = b[16+1:]
 	_, err = hex.Decode(ir.key[:], b[:32])
@@ -91,12 +356,27 @@ func (ir *indexRecord) decode(b []byte) error {
 	}
 
 	b = b[32+1:]
+	if len(b) == 0 {
+		ir.prevIndexOffset = math.MaxInt64
+		ir.hasChecksum = false
+		return nil
+	}
 	_, err = hex.Decode(aux, b[:16])
 	if err != nil {
 		return fmt.Errorf("wrong previous index offset: %v", err)
 	}
 	ir.prevIndexOffset = int64(binary.BigEndian.Uint64(aux))
 
+	ir.hasChecksum = len(b) > 16+1
+	if ir.hasChecksum {
+		b = b[16+1:]
+		_, err = hex.Decode(aux[:4], b[:8])
+		if err != nil {
+			return fmt.Errorf("wrong checksum: %v", err)
+		}
+		ir.checksum = binary.BigEndian.Uint32(aux)
+	}
+
 	return nil
 }
 
@@ -121,7 +401,11 @@ func (irw *indexRecordWriter) writeEntry(ir *indexRecord) []byte {
 	irw.buf[i] = spaceChar
 	i++ // Space
 
-	binary.BigEndian.PutUint64(irw.aux, uint64(ir.size))
+	size := ir.size
+	if ir.deleted {
+		size = tombstoneSize
+	}
+	binary.BigEndian.PutUint64(irw.aux, uint64(size))
 	i += hex.Encode(irw.buf[i:], irw.aux)
 	irw.buf[i] = spaceChar
 	i++ // Space
@@ -132,19 +416,34 @@ func (irw *indexRecordWriter) writeEntry(ir *indexRecord) []byte {
 
 	binary.BigEndian.PutUint64(irw.aux, uint64(ir.prevIndexOffset))
 	i += hex.Encode(irw.buf[i:], irw.aux)
+
+	if len(irw.buf) == indexRecordSize {
+		irw.buf[i] = spaceChar
+		i++ // Space
+
+		binary.BigEndian.PutUint32(irw.aux, ir.checksum)
+		i += hex.Encode(irw.buf[i:], irw.aux[:4])
+	}
 	irw.buf[i] = lfChar
 
 	return irw.buf
 }
 
-// newIndexRecordWriter initializes a new index record writer.
-func newIndexRecordWriter() *indexRecordWriter {
+// newIndexRecordWriter initializes a new index record writer, for records of
+// the given size (i.e. either in the current format or the format without
+// checksums).
+func newIndexRecordWriter(recordSize int64) *indexRecordWriter {
 	return &indexRecordWriter{
-		buf: make([]byte, indexRecordSize),
+		buf: make([]byte, recordSize),
 		aux: make([]byte, 8),
 	}
 }
 
+// compareKeys compares two keys lexicographically.
+func compareKeys(a, b Key) int {
+	return bytes.Compare(a[:], b[:])
+}
+
 func must(err error) {
 	if err != nil {
 		panic(err)
@@ -0,0 +1,240 @@
+package simplewaldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lockFileName is the name of the lock file inside the root dir.
+const lockFileName = "LOCK"
+
+// errLockHeld is returned by flockFile when the lock is held elsewhere.
+var errLockHeld = errors.New("lock is held")
+
+// dirLock is an advisory lock on the root dir of a DB. The exclusive lock is
+// held by processes that write to the DB, while the shared lock is held by
+// processes that only read its files to check them (see Verify). Read-only DBs
+// hold neither, so that they can be used along with a writer (see
+// WithReadOnly).
+type dirLock struct {
+	f         *os.File
+	exclusive bool
+}
+
+// lockRootDir takes the lock on the root dir, failing with ErrDBLocked if it is
+// held in a conflicting mode elsewhere. The holder of the exclusive lock writes
+// its PID into the lock file.
+func lockRootDir(rootDir string, exclusive bool) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(rootDir, lockFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flockFile(f, exclusive); errors.Is(err, errLockHeld) {
+		// The PID is only written by exclusive holders, so it may be
+		// missing.
+		var pid int
+		if b, err := os.ReadFile(f.Name()); err == nil {
+			pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+		}
+		f.Close()
+		return nil, ErrDBLocked{PID: pid}
+	} else if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking root dir: %v", err)
+	}
+
+	if exclusive {
+		err := f.Truncate(0)
+		if err == nil {
+			_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("error writing PID to lock file: %v", err)
+		}
+	}
+	return &dirLock{f: f, exclusive: exclusive}, nil
+}
+
+// unlock releases the lock.
+func (l *dirLock) unlock() error {
+	if l.exclusive {
+		// Ignore error because the lock is released on close anyway.
+		_ = l.f.Truncate(0)
+	}
+	return l.f.Close()
+}
+
+// tableLock is the readers-writer lock of a table. Unlike sync.RWMutex, waiting
+// for it may be given up (see lockContext and rLockContext), which withdraws
+// the request entirely.
+//
+// As with sync.RWMutex, a waiting writer blocks new readers (so that writers
+// are not starved by readers that continuously overlap), and readers that were
+// waiting when a writer unlocks acquire the lock before the next writer (so
+// that readers are not starved by writers either).
+type tableLock struct {
+	mu sync.Mutex
+
+	// readers is the number of readers holding the lock, and writer is set
+	// while a writer holds it.
+	readers int
+	writer  bool
+
+	// writersWaiting and readersWaiting are the number of goroutines waiting
+	// for the lock. readerPass is the number of waiting readers that may
+	// acquire it before any waiting writer, set when a writer unlocks.
+	writersWaiting int
+	readersWaiting int
+	readerPass     int
+
+	// wake is closed (and cleared) whenever the state changes, to wake all
+	// waiting goroutines.
+	wake chan struct{}
+}
+
+// waitChan returns the channel closed on the next state change.
+//
+// The caller must hold l.mu.
+func (l *tableLock) waitChan() <-chan struct{} {
+	if l.wake == nil {
+		l.wake = make(chan struct{})
+	}
+	return l.wake
+}
+
+// broadcast wakes all waiting goroutines.
+//
+// The caller must hold l.mu.
+func (l *tableLock) broadcast() {
+	if l.wake != nil {
+		close(l.wake)
+		l.wake = nil
+	}
+}
+
+// consumeReaderPass is called when a waiting reader stops waiting.
+//
+// The caller must hold l.mu.
+func (l *tableLock) consumeReaderPass() {
+	l.readersWaiting--
+	if l.readerPass > 0 {
+		l.readerPass--
+		if l.readerPass == 0 {
+			l.broadcast()
+		}
+	}
+}
+
+// lockContext acquires the lock for writing, giving up when ctx is done first.
+func (l *tableLock) lockContext(ctx context.Context) error {
+	l.mu.Lock()
+	canLock := func() bool { return !l.writer && l.readers == 0 && l.readerPass == 0 }
+	if canLock() {
+		l.writer = true
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.writersWaiting++
+	for {
+		wake := l.waitChan()
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.writersWaiting--
+			if l.writersWaiting == 0 {
+				// Readers may be blocked by this writer.
+				l.broadcast()
+			}
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+
+		l.mu.Lock()
+		if canLock() {
+			l.writersWaiting--
+			l.writer = true
+			l.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// rLockContext acquires the lock for reading, giving up when ctx is done first.
+func (l *tableLock) rLockContext(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.writer && l.writersWaiting == 0 {
+		l.readers++
+		l.mu.Unlock()
+		return nil
+	}
+
+	l.readersWaiting++
+	for {
+		wake := l.waitChan()
+		l.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.consumeReaderPass()
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+
+		l.mu.Lock()
+		if !l.writer && (l.writersWaiting == 0 || l.readerPass > 0) {
+			l.consumeReaderPass()
+			l.readers++
+			l.mu.Unlock()
+			return nil
+		}
+	}
+}
+
+// Lock acquires the lock for writing.
+func (l *tableLock) Lock() {
+	_ = l.lockContext(context.Background())
+}
+
+// RLock acquires the lock for reading.
+func (l *tableLock) RLock() {
+	_ = l.rLockContext(context.Background())
+}
+
+// Unlock releases the lock held for writing.
+func (l *tableLock) Unlock() {
+	l.mu.Lock()
+	if !l.writer {
+		l.mu.Unlock()
+		panic("unlock of unlocked table lock")
+	}
+	l.writer = false
+	l.readerPass = l.readersWaiting
+	l.broadcast()
+	l.mu.Unlock()
+}
+
+// RUnlock releases the lock held for reading.
+func (l *tableLock) RUnlock() {
+	l.mu.Lock()
+	if l.readers == 0 {
+		l.mu.Unlock()
+		panic("runlock of unlocked table lock")
+	}
+	l.readers--
+	if l.readers == 0 {
+		l.broadcast()
+	}
+	l.mu.Unlock()
+}
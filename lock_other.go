@@ -0,0 +1,10 @@
+//go:build !unix
+
+package simplewaldb
+
+import "os"
+
+// flockFile is a no-op outside unix platforms: root dirs are not locked.
+func flockFile(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package simplewaldb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestRootDirLock tests that a root dir can only be opened by a single DB.
+func TestRootDirLock(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("Root dirs are not locked in this platform")
+	}
+
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+
+	// The PID of the holder is in the lock file.
+	b, err := os.ReadFile(filepath.Join(rootDir, lockFileName))
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(os.Getpid()), strings.TrimSpace(string(b)))
+
+	// Opening the DB again fails.
+	_, err = NewDB(opts...)
+	require.ErrorIs(t, err, ErrDBLocked{})
+	require.Equal(t, ErrDBLocked{PID: os.Getpid()}, err)
+
+	// Offline tools also fail.
+	_, err = RebuildIndex(rootDir, tableName, strings.Repeat("00", 31))
+	require.ErrorIs(t, err, ErrDBLocked{})
+	_, err = Verify(rootDir)
+	require.ErrorIs(t, err, ErrDBLocked{})
+
+	// After closing, the DB can be opened again.
+	require.NoError(t, db.Close())
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Verifying only takes a shared lock, which blocks writers.
+	dirLock, err := lockRootDir(rootDir, false)
+	require.NoError(t, err)
+	_, err = Verify(rootDir)
+	require.NoError(t, err)
+	_, err = NewDB(opts...)
+	require.Equal(t, ErrDBLocked{}, err)
+	require.NoError(t, dirLock.unlock())
+}
+
+// TestTableLock tests the priority between readers and writers of table locks,
+// and giving up waiting for them.
+func TestTableLock(t *testing.T) {
+	var l tableLock
+	waiting := func(readers, writers int) func() bool {
+		return func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return l.readersWaiting == readers && l.writersWaiting == writers
+		}
+	}
+	timeout := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+
+	// A waiting writer blocks new readers, until it gives up.
+	l.RLock()
+	ctx, cancel := context.WithCancel(context.Background())
+	writerErr := make(chan error)
+	go func() { writerErr <- l.lockContext(ctx) }()
+	require.Eventually(t, waiting(0, 1), time.Second, time.Millisecond)
+	require.ErrorIs(t, l.rLockContext(timeout()), context.DeadlineExceeded)
+	cancel()
+	require.ErrorIs(t, <-writerErr, context.Canceled)
+	require.True(t, waiting(0, 0)())
+	require.NoError(t, l.rLockContext(timeout()))
+	l.RUnlock()
+	l.RUnlock()
+
+	// Readers that were waiting when a writer unlocks acquire the lock
+	// before the next writer.
+	l.Lock()
+	readerLocked, writerLocked := make(chan struct{}), make(chan struct{})
+	go func() {
+		l.RLock()
+		close(readerLocked)
+	}()
+	require.Eventually(t, waiting(1, 0), time.Second, time.Millisecond)
+	go func() {
+		l.Lock()
+		close(writerLocked)
+	}()
+	require.Eventually(t, waiting(1, 1), time.Second, time.Millisecond)
+	l.Unlock()
+	<-readerLocked
+	select {
+	case <-writerLocked:
+		t.Fatal("writer acquired the lock before the reader released it")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.RUnlock()
+	<-writerLocked
+	require.ErrorIs(t, l.rLockContext(timeout()), context.DeadlineExceeded)
+	l.Unlock()
+	require.True(t, waiting(0, 0)())
+	require.Zero(t, l.readers)
+	require.Zero(t, l.readerPass)
+	require.False(t, l.writer)
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package simplewaldb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flockFile takes an advisory lock on the file, without blocking. The lock is
+// released when the file is closed.
+func flockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLockHeld
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package simplewaldb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// manifestFileName is the name of the manifest file inside the root dir.
+const manifestFileName = "MANIFEST"
+
+// manifestVersion is the version of the manifest format.
+const manifestVersion = 1
+
+// dbManifest is the manifest of a DB, which records the tables of the DB and
+// the separator and file formats it was written with. It is stored as JSON in
+// the root dir and checked whenever the DB is opened.
+type dbManifest struct {
+	Version int `json:"version"`
+
+	// IndexFormat and DataFormat are the format versions of the index and
+	// data files written by the DB.
+	IndexFormat uint32 `json:"index_format"`
+	DataFormat  uint32 `json:"data_format"`
+
+	// SeparatorHash is the hex-encoded SHA-256 hash of the separator. Only
+	// the hash is stored, because the separator is meant to be secret.
+	SeparatorHash string `json:"separator_sha256"`
+
+	// Tables are the tables of the DB, sorted by name. These are not
+	// necessarily opened along with the DB, but their files must exist.
+	Tables []TableKey `json:"tables"`
+
+	// Rotations are the rotations of the separator (see
+	// DB.RotateSeparator), from the oldest to the most recent one.
+	Rotations []separatorRotation `json:"separator_rotations,omitempty"`
+}
+
+// separatorRotation is a rotation of the separator of the DB, which records
+// where the data written with the previous separator ends.
+type separatorRotation struct {
+	// PrevSeparatorHash is the hash of the separator in effect before the
+	// rotation.
+	PrevSeparatorHash string `json:"prev_separator_sha256"`
+
+	// DataFiles is the number of the first data file of each table written
+	// with the new separator. Tables created after the rotation are not
+	// included, because all of their data files were written with the new
+	// (or a later) separator.
+	DataFiles map[TableKey]uint32 `json:"data_files"`
+}
+
+// separatorHash returns the hash of a separator, as stored in the manifest.
+func separatorHash(sep recordSeparator) string {
+	hash := sha256.Sum256(sep[:])
+	return hex.EncodeToString(hash[:])
+}
+
+// newManifest returns the manifest of a new DB with the given separator.
+func newManifest(sep recordSeparator) *dbManifest {
+	return &dbManifest{
+		Version:       manifestVersion,
+		IndexFormat:   indexFormatVersion,
+		DataFormat:    dataFormatVersion,
+		SeparatorHash: separatorHash(sep),
+	}
+}
+
+// clone returns a deep copy of the manifest, so that it can be modified
+// without changing the original one until the copy is written.
+func (m *dbManifest) clone() *dbManifest {
+	c := *m
+	c.Tables = slices.Clone(m.Tables)
+	c.Rotations = make([]separatorRotation, len(m.Rotations))
+	for i, r := range m.Rotations {
+		c.Rotations[i] = separatorRotation{
+			PrevSeparatorHash: r.PrevSeparatorHash,
+			DataFiles:         maps.Clone(r.DataFiles),
+		}
+	}
+	return &c
+}
+
+// addTable adds a table to the manifest. It returns false if it was already in
+// the manifest.
+func (m *dbManifest) addTable(tableKey TableKey) bool {
+	i, found := slices.BinarySearch(m.Tables, tableKey)
+	if !found {
+		m.Tables = slices.Insert(m.Tables, i, tableKey)
+	}
+	return !found
+}
+
+// removeTable removes a table from the manifest. It is also removed from the
+// rotations of the separator, so that a new table with the same name is known
+// to only have data files written with the current separator.
+func (m *dbManifest) removeTable(tableKey TableKey) {
+	if i, found := slices.BinarySearch(m.Tables, tableKey); found {
+		m.Tables = slices.Delete(m.Tables, i, i+1)
+	}
+	for _, r := range m.Rotations {
+		delete(r.DataFiles, tableKey)
+	}
+}
+
+// dataFileSeparatorHash returns the hash of the separator that data file n of
+// the table was written with.
+func (m *dbManifest) dataFileSeparatorHash(tableKey TableKey, n uint32) string {
+	hash := m.SeparatorHash
+	for i := len(m.Rotations) - 1; i >= 0; i-- {
+		first, ok := m.Rotations[i].DataFiles[tableKey]
+		if !ok || n >= first {
+			break
+		}
+		hash = m.Rotations[i].PrevSeparatorHash
+	}
+	return hash
+}
+
+// dataFileSeparators returns the separator that each of the given data files of
+// a table was written with, out of the given separators (the current one
+// followed by any previous ones). If the DB has no manifest (m is nil), every
+// data file was written with the current separator.
+func (m *dbManifest) dataFileSeparators(tableKey TableKey, dataFileNums []uint32, seps []recordSeparator) (map[uint32]recordSeparator, error) {
+	byHash := make(map[string]recordSeparator, len(seps))
+	for _, sep := range seps {
+		byHash[separatorHash(sep)] = sep
+	}
+	res := make(map[uint32]recordSeparator, len(dataFileNums))
+	for _, n := range dataFileNums {
+		if m == nil {
+			res[n] = seps[0]
+			continue
+		}
+		sep, ok := byHash[m.dataFileSeparatorHash(tableKey, n)]
+		if !ok {
+			return nil, ErrMissingSeparator{Table: tableKey, DataFile: n}
+		}
+		res[n] = sep
+	}
+	return res, nil
+}
+
+// readManifest reads the manifest in the root dir. It returns nil (and no
+// error) if the root dir has no manifest.
+func readManifest(rootDir string) (*dbManifest, error) {
+	path := filepath.Join(rootDir, manifestFileName)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m dbManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	switch {
+	case m.Version > manifestVersion:
+		return nil, ErrUnsupportedFormat{File: path, Version: uint32(m.Version)}
+	case m.IndexFormat > indexFormatVersion:
+		return nil, ErrUnsupportedFormat{File: path, Version: m.IndexFormat}
+	case m.DataFormat > dataFormatVersion:
+		return nil, ErrUnsupportedFormat{File: path, Version: m.DataFormat}
+	}
+	slices.Sort(m.Tables)
+	return &m, nil
+}
+
+// loadManifest loads the manifest in the root dir and checks that it matches
+// the given separator. It returns nil (and no error) if the root dir has no
+// manifest.
+func loadManifest(rootDir string, sep recordSeparator) (*dbManifest, error) {
+	m, err := readManifest(rootDir)
+	if m == nil || err != nil {
+		return nil, err
+	}
+	if m.SeparatorHash != separatorHash(sep) {
+		hash := separatorHash(sep)
+		if slices.ContainsFunc(m.Rotations, func(r separatorRotation) bool {
+			return r.PrevSeparatorHash == hash
+		}) {
+			return nil, fmt.Errorf("%w (it was rotated)", ErrSeparatorMismatch)
+		}
+		return nil, ErrSeparatorMismatch
+	}
+	return m, nil
+}
+
+// checkTables checks that the index files of the tables of the manifest exist
+// in the root dir.
+func (m *dbManifest) checkTables(rootDir string) error {
+	for _, tableKey := range m.Tables {
+		indexPath := filepath.Join(rootDir, string(tableKey)+".index")
+		if _, err := os.Stat(indexPath); err != nil {
+			return fmt.Errorf("table %q of the manifest cannot be found: %v",
+				tableKey, err)
+		}
+	}
+	return nil
+}
+
+// encode encodes the manifest, as stored in the root dir.
+func (m *dbManifest) encode() ([]byte, error) {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, lfChar), nil
+}
+
+// writeManifest atomically replaces the manifest in the root dir.
+func writeManifest(rootDir string, m *dbManifest) error {
+	m.Version = manifestVersion
+	m.IndexFormat, m.DataFormat = indexFormatVersion, dataFormatVersion
+	b, err := m.encode()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(rootDir, manifestFileName), b)
+}
+
+// writeFileAtomic atomically replaces the file at path with one with the given
+// contents, through a temporary file.
+func writeFileAtomic(path string, b []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,241 @@
+package simplewaldb
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestManifest tests that the manifest records the tables and separator of the
+// DB and that it is checked when opening the DB.
+func TestManifest(t *testing.T) {
+	rootDir := t.TempDir()
+	sepHex := strings.Repeat("ab", 31)
+	opts := []Option{WithRootDir(rootDir), WithSeparatorHex(sepHex), WithTables("test2", "test1")}
+	manifestPath := filepath.Join(rootDir, manifestFileName)
+	readManifest := func() dbManifest {
+		t.Helper()
+		b, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		var m dbManifest
+		require.NoError(t, json.Unmarshal(b, &m))
+		return m
+	}
+
+	// The manifest is created along with the DB. The separator itself is
+	// not stored.
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	m := readManifest()
+	require.Equal(t, manifestVersion, m.Version)
+	require.Equal(t, uint32(indexFormatVersion), m.IndexFormat)
+	require.Equal(t, uint32(dataFormatVersion), m.DataFormat)
+	require.Equal(t, []TableKey{"test1", "test2"}, m.Tables)
+	b, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), sepHex)
+
+	// Tables that are created and dropped are added to and removed from
+	// the manifest.
+	require.NoError(t, db.CreateTable("test3"))
+	require.Equal(t, []TableKey{"test1", "test2", "test3"}, readManifest().Tables)
+	require.NoError(t, db.DropTable("test1"))
+	require.Equal(t, []TableKey{"test2", "test3"}, readManifest().Tables)
+	require.NoError(t, db.Close())
+
+	// Tables of the manifest are not required to be opened.
+	db, err = NewDB(WithRootDir(rootDir), WithSeparatorHex(sepHex), WithTables("test2"))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Equal(t, []TableKey{"test2", "test3"}, readManifest().Tables)
+
+	// The DB cannot be opened (or verified or rebuilt) with a different
+	// separator.
+	wrongSepHex := strings.Repeat("cd", 31)
+	wrongOpts := []Option{WithRootDir(rootDir), WithSeparatorHex(wrongSepHex), WithTables("test2")}
+	_, err = NewDB(wrongOpts...)
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+	_, err = NewDB(append(wrongOpts, WithReadOnly())...)
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+	_, err = Verify(rootDir, wrongOpts...)
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+	_, err = RebuildIndex(rootDir, "test2", wrongSepHex)
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+
+	// The DB cannot be opened if the files of a table of the manifest are
+	// missing.
+	indexPath := filepath.Join(rootDir, "test3.index")
+	require.NoError(t, os.Rename(indexPath, indexPath+".bak"))
+	_, err = NewDB(opts...)
+	require.ErrorContains(t, err, `table "test3" of the manifest`)
+	require.NoError(t, os.Rename(indexPath+".bak", indexPath))
+
+	// Manifests written by newer versions are not supported.
+	orig, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	m = readManifest()
+	m.Version = manifestVersion + 1
+	b, err = json.Marshal(m)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(manifestPath, b, 0o600))
+	_, err = NewDB(opts...)
+	require.ErrorIs(t, err, ErrUnsupportedFormat{})
+	require.NoError(t, os.WriteFile(manifestPath, orig, 0o600))
+
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.Equal(t, []TableKey{"test1", "test2", "test3"}, readManifest().Tables)
+}
+
+// TestRotateSeparator tests rotating the separator of a DB.
+func TestRotateSeparator(t *testing.T) {
+	tableNames := []TableKey{"test1", "test2", "test3"}
+	rootDir := t.TempDir()
+	seps := []string{strings.Repeat("a1", 31), strings.Repeat("b2", 31), strings.Repeat("c3", 31)}
+	opts := func(sep int) []Option {
+		return []Option{WithRootDir(rootDir), WithSeparatorHex(seps[sep]), WithDiscoverTables()}
+	}
+	value := func(k, v int) []byte { return []byte{byte(k), byte(v)} }
+	putAll := func(db *DB, tables []TableKey, v int) {
+		t.Helper()
+		txc := prepTestTx(t, db, WithWriteTables(tables...))
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range 5 {
+				for _, tableName := range tables {
+					tx.Put(tableName, keyFromInt(k), value(k, v))
+				}
+			}
+			return tx.Err()
+		})
+	}
+
+	// The last table does not have any records when the separator is
+	// rotated.
+	db, err := NewDB(append(opts(0), WithTables(tableNames...))...)
+	require.NoError(t, err)
+	putAll(db, tableNames[:2], 0)
+
+	// Separators cannot be reused.
+	require.Error(t, db.RotateSeparator(seps[0]))
+	require.NoError(t, db.RotateSeparator(seps[1]))
+	require.Error(t, db.RotateSeparator(seps[0]))
+	putAll(db, tableNames, 1)
+	require.NoError(t, db.Close())
+
+	// The DB cannot be opened with the old separator anymore.
+	_, err = NewDB(opts(0)...)
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+	require.ErrorContains(t, err, "rotated")
+
+	// Every table must be open to rotate the separator.
+	db, err = NewDB(WithRootDir(rootDir), WithSeparatorHex(seps[1]), WithTables("test1"))
+	require.NoError(t, err)
+	require.ErrorContains(t, db.RotateSeparator(seps[2]), `table "test2" is not open`)
+	require.NoError(t, db.Close())
+
+	// Rotate again, after dropping and creating again a table (so all of its
+	// data files are written with the new separator).
+	db, err = NewDB(opts(1)...)
+	require.NoError(t, err)
+	require.NoError(t, db.DropTable("test2"))
+	require.NoError(t, db.CreateTable("test2"))
+	putAll(db, tableNames, 2)
+	require.NoError(t, db.RotateSeparator(seps[2]))
+	putAll(db, tableNames, 3)
+	require.NoError(t, db.Close())
+
+	db, err = NewDB(opts(2)...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithReadTables(tableNames...))
+	runTestTx(t, txc, func(tx Tx) error {
+		for _, tableName := range tableNames {
+			tab := tx.MustTable(tableName)
+			var versions [][]byte
+			for v, err := range tab.History(keyFromInt(1)) {
+				require.NoError(t, err)
+				versions = append(versions, v.Data)
+			}
+			switch tableName {
+			case "test1":
+				require.Equal(t, [][]byte{value(1, 3), value(1, 2), value(1, 1), value(1, 0)}, versions)
+			case "test2":
+				require.Equal(t, [][]byte{value(1, 3), value(1, 2)}, versions)
+			case "test3":
+				require.Equal(t, [][]byte{value(1, 3), value(1, 2), value(1, 1)}, versions)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, db.Close())
+
+	// Verifying and rebuilding indexes requires the previous separators.
+	_, err = Verify(rootDir, opts(2)...)
+	require.ErrorIs(t, err, ErrMissingSeparator{})
+	report, err := Verify(rootDir, append(opts(2), WithPreviousSeparatorsHex(seps[1], seps[0]))...)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Issues)
+	require.Equal(t, map[TableKey]int{"test1": 20, "test2": 10, "test3": 15}, report.Records)
+
+	_, err = RebuildIndex(rootDir, "test1", seps[2], seps[1])
+	require.ErrorIs(t, err, ErrMissingSeparator{})
+	for _, tableName := range tableNames {
+		indexPath := filepath.Join(rootDir, string(tableName)+".index")
+		wantIndex, err := os.ReadFile(indexPath)
+		require.NoError(t, err)
+		n, err := RebuildIndex(rootDir, tableName, seps[2], seps[0], seps[1])
+		require.NoError(t, err)
+		require.Equal(t, report.Records[tableName], n)
+		gotIndex, err := os.ReadFile(indexPath)
+		require.NoError(t, err)
+		require.Equal(t, wantIndex, gotIndex)
+	}
+}
+
+// TestRotateSeparatorConcurrent tests that rotating the separator while a
+// transaction is in progress does not block the DB for that transaction, and
+// that tables cannot be created or dropped meanwhile.
+func TestRotateSeparatorConcurrent(t *testing.T) {
+	tableName := TableKey("test")
+	seps := []string{strings.Repeat("a1", 31), strings.Repeat("b2", 31)}
+	db, err := NewDB(WithRootDir(t.TempDir()), WithSeparatorHex(seps[0]), WithTables(tableName))
+	require.NoError(t, err)
+	defer db.Close()
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	tx, err := db.BeginTx(txc)
+	require.NoError(t, err)
+	require.NoError(t, tx.Put(tableName, Key{1}, []byte("value")).Err())
+	rotated := make(chan error, 1)
+	go func() { rotated <- db.RotateSeparator(seps[1]) }()
+
+	// Wait until the rotation is waiting for the table lock.
+	require.Eventually(t, func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.rotating
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []TableKey{tableName}, db.Tables())
+	require.ErrorContains(t, db.CreateTable("other"), "being rotated")
+	require.ErrorContains(t, db.DropTable(tableName), "being rotated")
+	require.ErrorContains(t, db.RotateSeparator(strings.Repeat("c3", 31)), "being rotated")
+	select {
+	case err := <-rotated:
+		t.Fatalf("rotation did not wait for the transaction (err %v)", err)
+	default:
+	}
+
+	require.NoError(t, tx.Commit())
+	require.NoError(t, <-rotated)
+	require.Equal(t, separatorHash(db.cfg.separator), db.manifest.SeparatorHash)
+	require.NoError(t, db.CreateTable("other"))
+	runTestTx(t, txc, func(tx Tx) error {
+		require.Equal(t, []byte("value"), tx.Get(tableName, Key{1}))
+		return tx.Err()
+	})
+}
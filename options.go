@@ -1,9 +1,17 @@
 package simplewaldb
 
 type config struct {
-	rootDir   string
-	tables    []TableKey
-	separator recordSeparator
+	rootDir         string
+	tables          []TableKey
+	separator       recordSeparator
+	prevSeparators  []recordSeparator
+	maxDataFileSize int64
+	readOnly        bool
+	discoverTables  bool
+
+	separatorCollisionCheck bool
+
+	checkpointInterval int64
 }
 
 // Option defines a config option of the database.
@@ -24,17 +32,116 @@ func WithTables(keys ...TableKey) Option {
 	}
 }
 
+// WithDiscoverTables opens every table found in the root dir (i.e. every table
+// that has an index file) when the DB is opened, in addition to the ones
+// defined with WithTables. The opened tables are returned by DB.Tables().
+func WithDiscoverTables() Option {
+	return func(c *config) {
+		c.discoverTables = true
+	}
+}
+
 // WithSeparatorHex defines the separator key for entries in the database. To
 // allow for manual recovery scenarios, this SHOULD be a random, 31-byte (i.e.
-// 62 hex chars) string. This SHOULD NOT be changed across DB invocations and
-// SHOULD be kept secret to avoid users attempting to replicate them in their
-// data.
+// 62 hex chars) string. This SHOULD NOT be changed across DB invocations (other
+// than by DB.RotateSeparator) and SHOULD be kept secret to avoid users
+// attempting to replicate them in their data.
+//
+// A hash of the separator is recorded in the manifest of the DB when it is
+// created, and opening the DB with a different separator fails with
+// ErrSeparatorMismatch.
 func WithSeparatorHex(hexData string) Option {
 	return func(c *config) {
 		must(c.separator.fromHex(hexData))
 	}
 }
 
+// WithPreviousSeparatorsHex defines the separators that were used by the DB
+// before its separator was rotated (see DB.RotateSeparator). These are only
+// needed by Verify, to check records written before the rotations.
+func WithPreviousSeparatorsHex(hexData ...string) Option {
+	return func(c *config) {
+		c.prevSeparators = make([]recordSeparator, len(hexData))
+		for i, s := range hexData {
+			must(c.prevSeparators[i].fromHex(s))
+		}
+	}
+}
+
+// WithSeparatorCollisionCheck checks the values written to tables for the
+// separator before staging them. Values that contain the separator (or that end
+// with bytes that would make the separator written after them be found earlier
+// than the end of the value) are rejected with ErrSeparatorCollision, because
+// RebuildIndex and manual recovery could not correctly split them from other
+// records.
+//
+// Without this option, values are written unchecked.
+func WithSeparatorCollisionCheck() Option {
+	return func(c *config) {
+		c.separatorCollisionCheck = true
+	}
+}
+
+// WithMaxDataFileSize defines the size (in bytes) after which a table starts
+// writing to a new data file. Data files other than the most recent one of each
+// table are never modified.
+//
+// Records are never split across data files, therefore data files may grow
+// past this size when a single record is larger than it. Zero (the default)
+// means tables only ever use a single data file.
+func WithMaxDataFileSize(size int64) Option {
+	return func(c *config) {
+		c.maxDataFileSize = size
+	}
+}
+
+// WithReadOnly opens the DB in read-only mode. Files are opened read-only,
+// tables that do not exist are not created and transactions cannot write to any
+// table (preparing them fails with ErrReadOnly).
+//
+// A read-only DB does not lock the root dir, therefore it may be opened while
+// another process has the DB open for writing. Records committed by the writer
+// after the DB was opened become visible after calling DB.Refresh().
+//
+// Note that this means read-only DBs do not take the shared lock on the root
+// dir (unlike Verify), because it would conflict with the exclusive lock held
+// by writers. As a consequence, a read-only DB does not stop other processes
+// from opening the DB for writing, nor from running RebuildIndex, Upgrade or
+// Compact, which replace index and data files. A read-only DB that is open
+// while files are replaced keeps reading the old ones, and must be reopened to
+// see the new ones.
+func WithReadOnly() Option {
+	return func(c *config) {
+		c.readOnly = true
+	}
+}
+
+// WithCheckpointInterval defines the number of index records written to a
+// table after which a checkpoint of its index is written. Opening a table loads
+// its checkpoint and only reads the index records written after it, instead of
+// the entire index.
+//
+// Checkpoints are written when committing transactions, while the table's write
+// lock is held, and take time proportional to the number of keys of the table.
+// Zero (the default) means checkpoints are never written, but existing ones
+// are still used.
+func WithCheckpointInterval(nbRecords int64) Option {
+	return func(c *config) {
+		c.checkpointInterval = nbRecords
+	}
+}
+
+// tableOptions returns the options for opening tables.
+func (c *config) tableOptions() tableOptions {
+	return tableOptions{
+		maxDataFileSize:    c.maxDataFileSize,
+		readOnly:           c.readOnly,
+		checkpointInterval: c.checkpointInterval,
+
+		separatorCollisionCheck: c.separatorCollisionCheck,
+	}
+}
+
 // defineOptions generates a new config object.
 func defineOptions(opts ...Option) *config {
 	// Defaults.
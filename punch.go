@@ -0,0 +1,123 @@
+package simplewaldb
+
+import (
+	"fmt"
+	"os"
+)
+
+// deadRange is a byte range of a dead record in a data file.
+type deadRange struct {
+	dataFile uint32
+	offset   int64
+	size     int64
+}
+
+// deadRanges returns the byte ranges of all dead records in the table. Dead
+// records are all the values of each key other than its current one (and all
+// values of deleted keys). Tombstones occupy no data, so they are never
+// returned.
+func (tab *table) deadRanges() ([]deadRange, error) {
+	var res []deadRange
+	for key := range tab.allKeys() {
+		isCurrent := true
+		err := tab.rangeRevEntries(key, func(ir indexRecord) error {
+			live := isCurrent && !ir.deleted
+			isCurrent = false
+			if live || ir.size == 0 {
+				return nil
+			}
+			res = append(res, deadRange{
+				dataFile: ir.dataFile,
+				offset:   ir.offset,
+				size:     ir.size,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// punchDeadRecords punches holes in the data files over all dead records of
+// the table. It returns the total size of the dead records.
+//
+// The caller must hold the table's write lock.
+func (tab *table) punchDeadRecords() (int64, error) {
+	ranges, err := tab.deadRanges()
+	if err != nil {
+		return 0, err
+	}
+
+	// Data files other than the current one are opened read-only, so open
+	// new handles for writing.
+	files := make(map[uint32]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var total int64
+	for _, r := range ranges {
+		f := files[r.dataFile]
+		if f == nil {
+			path := dataFilePath(tab.rootDir, tab.key, r.dataFile)
+			f, err = os.OpenFile(path, os.O_RDWR, 0)
+			if err != nil {
+				return total, err
+			}
+			files[r.dataFile] = f
+		}
+
+		if err := punchHole(f, r.offset, r.size); err != nil {
+			return total, fmt.Errorf("unable to punch hole in data file %d "+
+				"at offset %d: %w", r.dataFile, r.offset, err)
+		}
+		total += r.size
+	}
+
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return total, fmt.Errorf("error fsyncing data table: %v", err)
+		}
+	}
+	return total, nil
+}
+
+// PunchDeadRecords reclaims the storage used by dead records of the table
+// (i.e. all values of each key other than its current one, and all values of
+// deleted keys) by punching holes over them in the data files. It returns the
+// total size of the dead records.
+//
+// Only the data of the records is punched: record separators and keys are kept
+// intact, so the layout of the data files and all offsets remain valid. Reading
+// the history of a key returns zeroed data for punched records. Punching the
+// same records multiple times is harmless.
+//
+// This waits for backups in progress to finish. It is only supported on Linux,
+// in filesystems that support sparse files. On other platforms, it returns
+// ErrPunchHoleNotSupported.
+func (db *DB) PunchDeadRecords(tableKey TableKey) (int64, error) {
+	if db.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	db.backupMu.Lock()
+	defer db.backupMu.Unlock()
+
+	db.mu.Lock()
+	tab, lock := db.tables[tableKey], db.locks[tableKey]
+	db.mu.Unlock()
+	if tab == nil || lock == nil {
+		return 0, fmt.Errorf("table %q does not exist", tableKey)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if tab.dropped {
+		return 0, ErrTableDropped(tableKey)
+	}
+	return tab.punchDeadRecords()
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package simplewaldb
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+// punchHole deallocates the given byte range of the file, without changing its
+// size. Reads of the range return zeros afterwards.
+func punchHole(f *os.File, offset, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocFlPunchHole|fallocFlKeepSize, offset, size)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package simplewaldb
+
+import "os"
+
+// punchHole is not supported outside Linux.
+func punchHole(f *os.File, offset, size int64) error {
+	return ErrPunchHoleNotSupported
+}
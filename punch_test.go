@@ -0,0 +1,182 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestPunchDeadRecords tests punching holes over dead records.
+func TestPunchDeadRecords(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName), WithMaxDataFileSize(16384))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	const NBKEYS = 20
+	value := func(k, v int) []byte {
+		return bytes.Repeat([]byte{byte(k), byte(v)}, 1024)
+	}
+
+	// Write 3 versions of every key, then delete one of them.
+	for v := range 3 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range NBKEYS {
+				tx.Put(tableName, keyFromInt(k), value(k, v))
+			}
+			return tx.Err()
+		})
+	}
+	deletedKey := keyFromInt(0)
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Delete(tableName, deletedKey).Err()
+	})
+
+	dataFiles, err := listDataFiles(db.tables[tableName].rootDir, tableName)
+	require.NoError(t, err)
+	sizes := make(map[uint32]int64)
+	for _, n := range dataFiles {
+		stat, err := os.Stat(dataFilePath(db.tables[tableName].rootDir, tableName, n))
+		require.NoError(t, err)
+		sizes[n] = stat.Size()
+	}
+
+	punched, err := db.PunchDeadRecords(tableName)
+	if errors.Is(err, ErrPunchHoleNotSupported) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("Punching holes not supported: %v", err)
+	}
+	require.NoError(t, err)
+	require.Equal(t, int64((NBKEYS*2+1)*len(value(0, 0))), punched)
+
+	// File sizes did not change.
+	for _, n := range dataFiles {
+		stat, err := os.Stat(dataFilePath(db.tables[tableName].rootDir, tableName, n))
+		require.NoError(t, err)
+		require.Equal(t, sizes[n], stat.Size())
+	}
+
+	// Live values are intact, while dead ones were zeroed.
+	zeroed := make([]byte, len(value(0, 0)))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		for k := range NBKEYS {
+			key := keyFromInt(k)
+			var i int
+			for v, err := range tab.History(key) {
+				require.NoError(t, err)
+				switch {
+				case v.Deleted:
+				case i == 0:
+					require.Equal(t, value(k, 2), v.Data)
+				default:
+					require.Equal(t, zeroed, v.Data)
+				}
+				i++
+			}
+		}
+		return nil
+	})
+
+	// Punching again is harmless.
+	_, err = db.PunchDeadRecords(tableName)
+	require.NoError(t, err)
+}
+
+// TestPunchWaitsForBackup tests that punching holes waits for backups in
+// progress to finish.
+func TestPunchWaitsForBackup(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	for v := range 2 {
+		runTestTx(t, txc, func(tx Tx) error {
+			return tx.Put(tableName, keyFromInt(0), []byte{byte(v)}).Err()
+		})
+	}
+
+	// The backup blocks writing to the pipe until it is read.
+	pr, pw := io.Pipe()
+	backupDone := make(chan error, 1)
+	go func() {
+		_, err := db.Backup(pw)
+		pw.CloseWithError(err)
+		backupDone <- err
+	}()
+	_, err := pr.Read(make([]byte, 1))
+	require.NoError(t, err)
+
+	punchDone := make(chan error, 1)
+	go func() {
+		_, err := db.PunchDeadRecords(tableName)
+		punchDone <- err
+	}()
+	select {
+	case err := <-punchDone:
+		t.Fatalf("punching did not wait for the backup (err %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = io.Copy(io.Discard, pr)
+	require.NoError(t, err)
+	require.NoError(t, <-backupDone)
+	err = <-punchDone
+	if errors.Is(err, ErrPunchHoleNotSupported) || errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skipf("Punching holes not supported: %v", err)
+	}
+	require.NoError(t, err)
+}
+
+// TestZeroedLiveRecord tests that zeroed data is only accepted (as punched) for
+// dead records, while it is reported as a checksum mismatch for live records.
+func TestZeroedLiveRecord(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	deadKey, liveKey := keyFromInt(1), keyFromInt(2)
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, deadKey, []byte("dead")).Put(tableName, liveKey, []byte("live")).Err()
+	})
+	tab := db.tables[tableName]
+	deadIR, liveIR := *tab.index[deadKey], *tab.index[liveKey]
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, deadKey, []byte("current")).Err()
+	})
+
+	// Zero the data of the first version of deadKey and of liveKey.
+	f, err := os.OpenFile(dataFilePath(rootDir, tableName, 0), os.O_RDWR, 0)
+	require.NoError(t, err)
+	for _, ir := range []indexRecord{deadIR, liveIR} {
+		_, err = f.WriteAt(make([]byte, ir.size), ir.offset)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	txc = prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		var versions [][]byte
+		for v, err := range tab.History(deadKey) {
+			require.NoError(t, err)
+			versions = append(versions, v.Data)
+		}
+		require.Equal(t, [][]byte{[]byte("current"), make([]byte, 4)}, versions)
+		_, err := tab.Get(liveKey)
+		require.ErrorIs(t, err, ErrChecksumMismatch{})
+		return nil
+	})
+	require.NoError(t, db.Close())
+
+	report, err := Verify(rootDir, opts...)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 1)
+	require.Equal(t, IssueChecksumMismatch, report.Issues[0].Kind)
+	require.Equal(t, liveIR.indexOffset, report.Issues[0].IndexOffset)
+}
@@ -0,0 +1,111 @@
+package simplewaldb
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// reopen closes and reopens the files of the table, discarding its in-memory
+// state.
+func (tab *table) reopen() error {
+	sep := recordSeparator(tab.sepBuffer[:recordSeparatorSize])
+	newTab, err := newTable(tab.rootDir, tab.key, sep, tab.opts)
+	if err != nil {
+		return err
+	}
+
+	// Ignore error because the files are no longer used.
+	_ = tab.close()
+	*tab = *newTab
+	return nil
+}
+
+// refresh reads the index records appended (by a writer in another process)
+// since the table was opened or last refreshed. If the index file was replaced
+// or truncated (for example, by a compaction), the table is reopened.
+//
+// The caller must hold the table's write lock.
+func (tab *table) refresh() error {
+	indexPath := filepath.Join(tab.rootDir, string(tab.key)+".index")
+	pathStat, err := os.Stat(indexPath)
+	if err != nil {
+		return err
+	}
+	fileStat, err := tab.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(pathStat, fileStat) || fileStat.Size() < tab.indexSize {
+		return tab.reopen()
+	}
+
+	// Only complete lines are read. A partial line is a write in progress.
+	nbNew := (fileStat.Size() - tab.indexSize) / tab.irSize
+	if nbNew == 0 {
+		return nil
+	}
+	buf := make([]byte, nbNew*tab.irSize)
+	if _, err := tab.indexFile.ReadAt(buf, tab.indexSize); err != nil {
+		return fmt.Errorf("error reading index: %v", err)
+	}
+	for len(buf) > 0 {
+		var ir indexRecord
+		if err := ir.decode(buf[:tab.irSize]); err != nil {
+			return fmt.Errorf("error reading index entry at offset %d: %v",
+				tab.indexSize, err)
+		}
+		ir.indexOffset = tab.indexSize
+
+		// Open data files started by the writer after the table was
+		// opened.
+		if tab.dataFiles[ir.dataFile] == nil {
+			f, err := os.Open(dataFilePath(tab.rootDir, tab.key, ir.dataFile))
+			if err != nil {
+				return err
+			}
+			tab.dataFiles[ir.dataFile] = f
+			if ir.dataFile > tab.curDataFile {
+				tab.dataFile, tab.curDataFile = f, ir.dataFile
+			}
+		}
+
+		tab.setEntry(ir)
+		tab.indexSize += tab.irSize
+		buf = buf[tab.irSize:]
+	}
+	return nil
+}
+
+// Refresh makes the records committed by the writer of the DB (i.e. another
+// process) since the DB was opened or last refreshed visible to new
+// transactions. Tables are refreshed one at a time, while holding their write
+// lock, therefore a transaction committed across multiple tables may become
+// visible in only some of them if it is committed while they are refreshed.
+//
+// This is a no-op if the DB is not read-only.
+func (db *DB) Refresh() error {
+	if !db.readOnly {
+		return nil
+	}
+
+	db.mu.Lock()
+	tableKeys := slices.Sorted(maps.Keys(db.tables))
+	db.mu.Unlock()
+
+	for _, key := range tableKeys {
+		db.mu.Lock()
+		tab, lock := db.tables[key], db.locks[key]
+		db.mu.Unlock()
+
+		lock.Lock()
+		err := tab.refresh()
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("error refreshing table %q: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestReadOnly tests opening a DB in read-only mode while it is being written
+// to.
+func TestReadOnly(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	writer := newTestDB(t, WithRootDir(rootDir), WithTables(tableName),
+		WithMaxDataFileSize(2048))
+	wtxc := prepTestTx(t, writer, WithWriteTables(tableName))
+
+	value := func(k, v int) []byte { return bytes.Repeat([]byte{byte(k), byte(v)}, 100) }
+	writeKeys := func(nbKeys, v int) {
+		runTestTx(t, wtxc, func(tx Tx) error {
+			for k := range nbKeys {
+				tx.Put(tableName, keyFromInt(k), value(k, v))
+			}
+			return tx.Err()
+		})
+	}
+	writeKeys(5, 0)
+
+	// Open the DB read-only (while the writer still has it open).
+	reader, err := NewDB(WithRootDir(rootDir), WithTables(tableName), WithReadOnly())
+	require.NoError(t, err)
+	defer reader.Close()
+	rtxc := prepTestTx(t, reader, WithReadTables(tableName))
+	checkKeys := func(nbKeys, v int) {
+		t.Helper()
+		runTestTx(t, rtxc, func(tx Tx) error {
+			tab := tx.MustTable(tableName)
+			count, err := tab.Count()
+			require.NoError(t, err)
+			require.Equal(t, nbKeys, count)
+			for k := range nbKeys {
+				data, err := tab.Get(keyFromInt(k))
+				require.NoError(t, err)
+				require.Equal(t, value(k, v), data)
+			}
+			return nil
+		})
+	}
+	checkKeys(5, 0)
+
+	// Writes are refused.
+	_, err = reader.PrepareTx(WithWriteTables(tableName))
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, reader.Compact(tableName), ErrReadOnly)
+	_, err = reader.PunchDeadRecords(tableName)
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	// New writes (which start new data files) are only seen after
+	// refreshing.
+	writeKeys(20, 1)
+	checkKeys(5, 0)
+	require.NoError(t, reader.Refresh())
+	checkKeys(20, 1)
+	require.Greater(t, len(reader.tables[tableName].dataFiles), 1)
+
+	// A compaction by the writer replaces the index file.
+	require.NoError(t, writer.Compact(tableName))
+	writeKeys(10, 2)
+	require.NoError(t, reader.Refresh())
+	runTestTx(t, rtxc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		for k := range 20 {
+			wantValue := value(k, 1)
+			if k < 10 {
+				wantValue = value(k, 2)
+			}
+			data, err := tab.Get(keyFromInt(k))
+			require.NoError(t, err)
+			require.Equal(t, wantValue, data)
+		}
+		return nil
+	})
+
+	// Missing tables and root dirs are not created.
+	_, err = NewDB(WithRootDir(rootDir), WithTables("missing"), WithReadOnly())
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(rootDir, "missing.index"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(dataFilePath(rootDir, "missing", 0))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	missingDir := filepath.Join(rootDir, "missing")
+	_, err = NewDB(WithRootDir(missingDir), WithTables(tableName), WithReadOnly())
+	require.Error(t, err)
+	_, err = os.Stat(missingDir)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,378 @@
+package simplewaldb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// scannedRecord is a record found by scanning a data file.
+type scannedRecord struct {
+	offset  int64
+	size    int64
+	key     Key
+	deleted bool
+
+	// checksum is the CRC32 (Castagnoli) of the record's data.
+	checksum uint32
+}
+
+// recordTrailerSize is the size of what follows the data of every record in
+// data files: the separator, the hex-encoded key and the padding.
+const recordTrailerSize = recordSeparatorSize + KeySize*2 + recordPaddingSize
+
+// decodeRecordTrailer decodes the key and padding that follow a separator.
+// It returns false if they are not valid (which happens, for example, if the
+// separator is part of some record's data).
+func decodeRecordTrailer(b []byte) (key Key, deleted bool, ok bool) {
+	if _, err := hex.Decode(key[:], b[:KeySize*2]); err != nil {
+		return key, false, false
+	}
+	padding := b[KeySize*2 : KeySize*2+recordPaddingSize]
+	if string(padding) == tombstoneMarker {
+		return key, true, true
+	}
+	for _, c := range padding {
+		if c != lfChar {
+			return key, false, false
+		}
+	}
+	return key, false, true
+}
+
+// scanDataRecords scans a data file for records terminated by the given
+// separator, calling f for every record found. The reader must be positioned at
+// the offset start of the file (i.e. after its header). It returns the offset
+// right after the last complete record (any bytes after it are a torn or
+// orphaned tail).
+//
+// Only a small window of the file is kept in memory.
+func scanDataRecords(r io.Reader, start int64, sep recordSeparator, f func(scannedRecord) error) (int64, error) {
+	const chunkSize = 64 * 1024
+
+	var buf []byte
+	bufOffset := start   // Offset in the file of buf[0].
+	recordStart := start // Offset in the file of the current record.
+	var searchFrom int   // Position in buf to search for the separator.
+	var crc uint32       // Checksum of the current record's data before buf.
+	eof := false
+	for {
+		i := bytes.Index(buf[searchFrom:], sep[:])
+		if i >= 0 {
+			i += searchFrom
+			trailerEnd := i + recordTrailerSize
+			if trailerEnd <= len(buf) {
+				key, deleted, ok := decodeRecordTrailer(buf[i+recordSeparatorSize : trailerEnd])
+				if !ok {
+					// Not a record boundary.
+					searchFrom = i + 1
+					continue
+				}
+				rec := scannedRecord{
+					offset:   recordStart,
+					size:     bufOffset + int64(i) - recordStart,
+					key:      key,
+					deleted:  deleted,
+					checksum: crc32.Update(crc, crc32cTable, buf[:i]),
+				}
+				if err := f(rec); err != nil {
+					return recordStart, err
+				}
+				recordStart = bufOffset + int64(trailerEnd)
+				buf = buf[trailerEnd:]
+				bufOffset += int64(trailerEnd)
+				searchFrom = 0
+				crc = 0
+				continue
+			}
+			// Need more data to decode the trailer.
+			searchFrom = i
+		} else {
+			// Keep only enough data to find a separator that crosses
+			// the chunk boundary.
+			keep := min(len(buf), recordSeparatorSize-1)
+			drop := len(buf) - keep
+			crc = crc32.Update(crc, crc32cTable, buf[:drop])
+			buf = buf[drop:]
+			bufOffset += int64(drop)
+			searchFrom = 0
+		}
+
+		if eof {
+			return recordStart, nil
+		}
+
+		// Read the next chunk.
+		buf = append(buf, make([]byte, chunkSize)...)
+		n, err := io.ReadFull(r, buf[len(buf)-chunkSize:])
+		buf = buf[:len(buf)-chunkSize+n]
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			eof = true
+		} else if err != nil {
+			return recordStart, err
+		}
+	}
+}
+
+// RebuildIndex rebuilds the index of a table from its data files, which MUST
+// have been written with the given separator (the same hex string passed to
+// WithSeparatorHex). It returns the number of records in the new index.
+//
+// Data files are scanned in order, looking for record separators. Each
+// separator is followed by the hex-encoded key of the record, which allows
+// reconstructing the offset, size and key of every record, as well as the chain
+// of previous versions of each key. Any existing index file is moved into the
+// archive dir. This fails with ErrSeparatorMismatch if the separator does not
+// match the one in the manifest of the DB.
+//
+// If the separator of the DB was rotated (see DB.RotateSeparator), data files
+// written before the rotations are scanned with the previous separators, which
+// must be given as well (in any order).
+//
+// Note that records written by transactions that were never committed (for
+// example, due to a crash) are also restored, and that records that contain the
+// separator in their data are not correctly rebuilt.
+//
+// This fails with ErrDBLocked if the DB is open.
+func RebuildIndex(rootDir string, tableKey TableKey, separatorHex string, prevSeparatorsHex ...string) (int, error) {
+	seps := make([]recordSeparator, 1+len(prevSeparatorsHex))
+	for i, s := range append([]string{separatorHex}, prevSeparatorsHex...) {
+		if err := seps[i].fromHex(s); err != nil {
+			return 0, fmt.Errorf("invalid separator: %v", err)
+		}
+	}
+
+	dirLock, err := lockRootDir(rootDir, true)
+	if err != nil {
+		return 0, err
+	}
+	defer dirLock.unlock()
+
+	manifest, err := loadManifest(rootDir, seps[0])
+	if err != nil {
+		return 0, err
+	}
+
+	dataFileNums, err := listDataFiles(rootDir, tableKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(dataFileNums) == 0 {
+		return 0, fmt.Errorf("table %q has no data files", tableKey)
+	}
+	dataFileSeps, err := manifest.dataFileSeparators(tableKey, dataFileNums, seps)
+	if err != nil {
+		return 0, err
+	}
+
+	indexPath := filepath.Join(rootDir, string(tableKey)+".index")
+	newIndexPath := indexPath + ".rebuild"
+	newIndexFile, err := os.OpenFile(newIndexPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return 0, err
+	}
+	fail := func(err error) (int, error) {
+		newIndexFile.Close()
+		os.Remove(newIndexPath)
+		return 0, err
+	}
+
+	// Scan every data file, writing index records as they are found.
+	irw := newIndexRecordWriter(indexRecordSize)
+	indexWriter := bufio.NewWriter(newIndexFile)
+	if _, err := indexWriter.Write(encodeFileHeader(indexFileMagic, indexFormatVersion)); err != nil {
+		return fail(err)
+	}
+	lastIndexOffset := make(map[Key]int64)
+	indexOffset := int64(fileHeaderSize)
+	var nbRecords int
+	for _, n := range dataFileNums {
+		f, err := os.Open(dataFilePath(rootDir, tableKey, n))
+		if err != nil {
+			return fail(err)
+		}
+		start, err := readDataFileStart(f)
+		if err == nil {
+			_, err = f.Seek(start, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return fail(err)
+		}
+		_, err = scanDataRecords(bufio.NewReader(f), start, dataFileSeps[n], func(rec scannedRecord) error {
+			ir := indexRecord{
+				dataFile:        n,
+				offset:          rec.offset,
+				size:            rec.size,
+				key:             rec.key,
+				deleted:         rec.deleted,
+				prevIndexOffset: math.MaxInt64,
+				checksum:        rec.checksum,
+				hasChecksum:     true,
+			}
+			if prev, ok := lastIndexOffset[rec.key]; ok {
+				ir.prevIndexOffset = prev
+			}
+			if _, err := indexWriter.Write(irw.writeEntry(&ir)); err != nil {
+				return err
+			}
+			lastIndexOffset[rec.key] = indexOffset
+			indexOffset += indexRecordSize
+			nbRecords++
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return fail(fmt.Errorf("error scanning data file %d: %v", n, err))
+		}
+	}
+	if err := indexWriter.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := newIndexFile.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := newIndexFile.Close(); err != nil {
+		return fail(err)
+	}
+
+	// Archive the old index (if there is one) and move the new one into
+	// place. The checkpoint of the old index is no longer valid.
+	if err := removeCheckpoint(rootDir, tableKey); err != nil {
+		return fail(err)
+	}
+	if _, err := os.Stat(indexPath); err == nil {
+		archiveDir, err := newArchiveDir(rootDir, tableKey, "rebuild")
+		if err != nil {
+			return fail(err)
+		}
+		err = os.Rename(indexPath, filepath.Join(archiveDir, filepath.Base(indexPath)))
+		if err != nil {
+			return fail(err)
+		}
+	}
+	if err := os.Rename(newIndexPath, indexPath); err != nil {
+		return 0, err
+	}
+	return nbRecords, syncDir(rootDir)
+}
+
+// TableRepair describes what was repaired in the files of a table when it was
+// opened. Repairs are needed when the process crashes while committing a
+// transaction: the bytes written after the committed parts of the files are
+// removed (after being saved into ArchiveDir).
+type TableRepair struct {
+	Table TableKey
+
+	// TornIndexBytes is the size of a partially written line that was
+	// removed from the end of the index.
+	TornIndexBytes int64
+
+	// OrphanedDataBytes is the number of bytes that were removed from the
+	// end of each data file (keyed by data file number), because they were
+	// not referenced by any index record.
+	OrphanedDataBytes map[uint32]int64
+
+	// ArchiveDir is the dir where the removed bytes were saved.
+	ArchiveDir string
+}
+
+// IsEmpty returns true if nothing was repaired.
+func (r *TableRepair) IsEmpty() bool {
+	return r.TornIndexBytes == 0 && len(r.OrphanedDataBytes) == 0
+}
+
+// quarantineTail saves the bytes of f after offset into a new file in the
+// repair archive dir (created on first use), then truncates f at offset.
+func (tab *table) quarantineTail(f *os.File, offset, size int64, name string) error {
+	if tab.repair.ArchiveDir == "" {
+		dir, err := newArchiveDir(tab.rootDir, tab.key, "repair")
+		if err != nil {
+			return err
+		}
+		tab.repair.ArchiveDir = dir
+	}
+
+	out, err := os.OpenFile(filepath.Join(tab.repair.ArchiveDir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f, offset, size-offset))
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(tab.repair.ArchiveDir); err != nil {
+		return err
+	}
+
+	// Data files other than the current one are opened read-only, so
+	// truncate through their path.
+	if err := os.Truncate(f.Name(), offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// repairTails removes a partially written line from the end of the index and
+// any data after the last indexed record of each data file. dataEnds maps each
+// data file to the end of its last indexed record.
+//
+// The index has already been replayed from the WAL when this is called, so
+// anything after these points was never committed.
+func (tab *table) repairTails(dataEnds map[uint32]int64) error {
+	tab.repair = TableRepair{Table: tab.key}
+
+	stat, err := tab.indexFile.Stat()
+	if err != nil {
+		return err
+	}
+	if size := stat.Size(); size > tab.indexSize {
+		name := filepath.Base(tab.indexFile.Name()) + ".torn"
+		if err := tab.quarantineTail(tab.indexFile, tab.indexSize, size, name); err != nil {
+			return err
+		}
+		tab.repair.TornIndexBytes = size - tab.indexSize
+	}
+
+	for n, f := range tab.dataFiles {
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size, end := stat.Size(), dataEnds[n]
+		if size <= end {
+			continue
+		}
+		name := filepath.Base(f.Name()) + ".orphaned"
+		if err := tab.quarantineTail(f, end, size, name); err != nil {
+			return err
+		}
+		if tab.repair.OrphanedDataBytes == nil {
+			tab.repair.OrphanedDataBytes = make(map[uint32]int64)
+		}
+		tab.repair.OrphanedDataBytes[n] = size - end
+	}
+	return nil
+}
+
+// Repairs returns what was repaired in the files of each table when the DB was
+// opened. Tables that did not need any repairs are not included.
+func (db *DB) Repairs() []TableRepair {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.repairs
+}
@@ -0,0 +1,204 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestRebuildIndex tests rebuilding the index of a table from its data files.
+func TestRebuildIndex(t *testing.T) {
+	const sepHex = "ce6dcbb021ea09d2c6e77714d7cdefcdf28fe1e0b4221e24d78648efe10ed8"
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{
+		WithRootDir(rootDir),
+		WithTables(tableName),
+		WithSeparatorHex(sepHex),
+		WithMaxDataFileSize(16384),
+	}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	// Write multiple versions of some keys (including data that contains
+	// part of the separator and empty values), then delete some of them.
+	const NBKEYS = 20
+	value := func(k, v int) []byte {
+		b := bytes.Repeat([]byte{byte(k), byte(v)}, 512*k)
+		return append(b, "\n"+sepHex[:40]...)
+	}
+	for v := range 3 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range NBKEYS {
+				tx.Put(tableName, keyFromInt(k), value(k, v))
+			}
+			return tx.Err()
+		})
+	}
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Delete(tableName, keyFromInt(0)).Delete(tableName, keyFromInt(5)).Err()
+	})
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, keyFromInt(5), value(5, 3)).Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Lose the index.
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	wantIndex, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(indexPath))
+
+	// The rebuilt index is the same as the original one.
+	n, err := RebuildIndex(rootDir, tableName, sepHex)
+	require.NoError(t, err)
+	require.Equal(t, NBKEYS*3+3, n)
+	gotIndex, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, wantIndex, gotIndex)
+
+	// Rebuilding again archives the existing index.
+	_, err = RebuildIndex(rootDir, tableName, sepHex)
+	require.NoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(rootDir, archiveDirName))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, strings.HasPrefix(entries[0].Name(), string(tableName)+".rebuild."))
+
+	// The DB works with the rebuilt index.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	txc = prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		count, err := tab.Count()
+		require.NoError(t, err)
+		require.Equal(t, NBKEYS-1, count)
+		for k := range NBKEYS {
+			data, err := tab.Get(keyFromInt(k))
+			switch k {
+			case 0:
+				require.Error(t, err)
+			case 5:
+				require.NoError(t, err)
+				require.Equal(t, value(k, 3), data)
+			default:
+				require.NoError(t, err)
+				require.Equal(t, value(k, 2), data)
+			}
+		}
+		return nil
+	})
+	require.NoError(t, db.Close())
+
+	// A wrong separator is rejected, because it does not match the one in
+	// the manifest. Without a manifest, it does not find any record.
+	_, err = RebuildIndex(rootDir, tableName, strings.Repeat("00", 31))
+	require.ErrorIs(t, err, ErrSeparatorMismatch)
+	require.NoError(t, os.Remove(filepath.Join(rootDir, manifestFileName)))
+	n, err = RebuildIndex(rootDir, tableName, strings.Repeat("00", 31))
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+// TestRepairTails tests that uncommitted bytes at the end of the index and data
+// files are removed when the table is opened.
+func TestRepairTails(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	require.Empty(t, db.Repairs())
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	const NBKEYS = 10
+	value := func(k int) []byte { return bytes.Repeat([]byte{byte(k)}, 100) }
+	runTestTx(t, txc, func(tx Tx) error {
+		for k := range NBKEYS {
+			tx.Put(tableName, keyFromInt(k), value(k))
+		}
+		return tx.Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Simulate a crash while committing: data was appended to the current
+	// data file and to a new one, and an index line was partially written.
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	dataPath := dataFilePath(rootDir, tableName, 0)
+	newDataPath := dataFilePath(rootDir, tableName, 1)
+	appendFile := func(path string, b []byte) int64 {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		require.NoError(t, err)
+		stat, err := f.Stat()
+		require.NoError(t, err)
+		_, err = f.Write(b)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		return stat.Size()
+	}
+	orphanedData := []byte("orphaned data")
+	tornIndex := []byte("00000000 00000000")
+	dataSize := appendFile(dataPath, orphanedData)
+	appendFile(newDataPath, orphanedData)
+	indexSize := appendFile(indexPath, tornIndex)
+
+	// Reopening the DB repairs the files.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	repairs := db.Repairs()
+	require.Len(t, repairs, 1)
+	repair := repairs[0]
+	require.Equal(t, tableName, repair.Table)
+	require.Equal(t, int64(len(tornIndex)), repair.TornIndexBytes)
+	wantOrphaned := map[uint32]int64{0: int64(len(orphanedData)), 1: int64(len(orphanedData))}
+	require.Equal(t, wantOrphaned, repair.OrphanedDataBytes)
+
+	// The removed bytes were saved in the archive.
+	got, err := os.ReadFile(filepath.Join(repair.ArchiveDir, filepath.Base(indexPath)+".torn"))
+	require.NoError(t, err)
+	require.Equal(t, tornIndex, got)
+	for _, path := range []string{dataPath, newDataPath} {
+		got, err := os.ReadFile(filepath.Join(repair.ArchiveDir, filepath.Base(path)+".orphaned"))
+		require.NoError(t, err)
+		require.Equal(t, orphanedData, got)
+	}
+
+	// The files were truncated.
+	for path, size := range map[string]int64{indexPath: indexSize, dataPath: dataSize, newDataPath: 0} {
+		stat, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, size, stat.Size())
+	}
+
+	// The DB is usable.
+	txc = prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		for k := range NBKEYS {
+			data, err := tab.Get(keyFromInt(k))
+			require.NoError(t, err)
+			require.Equal(t, value(k), data)
+		}
+		return tab.Put(keyFromInt(NBKEYS), value(NBKEYS))
+	})
+	require.NoError(t, db.Close())
+
+	// Nothing is repaired the next time.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Empty(t, db.Repairs())
+	txc = prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		data, err := tab.Get(keyFromInt(NBKEYS))
+		require.NoError(t, err)
+		require.Equal(t, value(NBKEYS), data)
+		return nil
+	})
+}
@@ -2,36 +2,170 @@ package simplewaldb
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"iter"
+	"maps"
 	"math"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/btree"
 )
 
+// tableOptions are the options for opening a table.
+type tableOptions struct {
+	// maxDataFileSize is the size after which a new data file is started.
+	// Zero means data files are never rotated.
+	maxDataFileSize int64
+
+	// readOnly is true if the files are opened read-only. Missing files are
+	// not created and torn tails are not repaired.
+	readOnly bool
+
+	// checkpointInterval is the number of index records after which a
+	// checkpoint is written. Zero means checkpoints are never written.
+	checkpointInterval int64
+
+	// separatorCollisionCheck is true if values that contain the separator
+	// are rejected.
+	separatorCollisionCheck bool
+}
+
+// dataFilePath returns the path to the given data file of a table. The first
+// data file (number 0) does not have a numeric suffix.
+func dataFilePath(rootDir string, tableName TableKey, n uint32) string {
+	name := string(tableName) + ".data"
+	if n > 0 {
+		name += fmt.Sprintf(".%08x", n)
+	}
+	return filepath.Join(rootDir, name)
+}
+
+// listDataFiles returns the numbers of the existing data files of a table, in
+// ascending order.
+func listDataFiles(rootDir string, tableName TableKey) ([]uint32, error) {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []uint32
+	prefix := string(tableName) + ".data"
+	for _, e := range entries {
+		name := e.Name()
+		if name == prefix {
+			res = append(res, 0)
+			continue
+		}
+		suffix, ok := strings.CutPrefix(name, prefix+".")
+		if !ok || len(suffix) != 8 {
+			continue
+		}
+		var b [4]byte
+		if _, err := hex.Decode(b[:], []byte(suffix)); err != nil {
+			continue
+		}
+		if n := binary.BigEndian.Uint32(b[:]); n > 0 {
+			res = append(res, n)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
 // table is a single table in the database.
 type table struct {
-	key TableKey
-	sep recordSeparator
+	key     TableKey
+	sep     recordSeparator
+	rootDir string
+	opts    tableOptions
 
 	// sepBuffer is a buffer to write the key and separator.
 	sepBuffer []byte
 
-	// irw is the writer of index records.
-	irw *indexRecordWriter
+	// irw is the writer of index records, and irSize the size of the
+	// records of the index file (which depends on its format). indexStart
+	// is the offset of the first record in the index file.
+	irw        *indexRecordWriter
+	irSize     int64
+	indexStart int64
+
+	// dataFiles are all data files of the table, keyed by their number.
+	// Only the current data file (dataFile, numbered curDataFile) is ever
+	// appended to.
+	dataFiles   map[uint32]*os.File
+	dataFile    *os.File
+	curDataFile uint32
+
+	// dataEnds is the end of the last indexed record of each data file (or
+	// of its header, if it has no indexed records). Data after it was never
+	// committed.
+	dataEnds map[uint32]int64
 
-	dataFile  *os.File
 	indexFile *os.File
 
+	// indexSize is the size of the committed part of the index file.
+	indexSize int64
+
+	// checkpointOffset is the size of the index covered by the last
+	// checkpoint of the table.
+	checkpointOffset int64
+
+	// pending are writes staged by the current transaction, which are only
+	// written to the files when it is committed. Only the holder of the
+	// table's write lock may access them. pendingOrder tracks the order in
+	// which keys were first written.
+	pending      map[Key]pendingWrite
+	pendingOrder []Key
+
+	// prepared and walBuf are the index records (decoded and encoded) of
+	// the pending writes, while they are being committed. preparedFrom is
+	// the current data file when they started being prepared.
+	prepared     []indexRecord
+	walBuf       []byte
+	preparedFrom uint32
+
 	// index maps an entry code
 	index map[Key]*indexRecord
+
+	// keys are all keys of the index (including deleted ones), in
+	// lexicographic order. A B-tree is used so that inserting new keys
+	// does not require moving all greater keys.
+	keys *btree.BTreeG[Key]
+
+	// nbLive is the number of keys in the index that are not deleted.
+	nbLive int
+
+	// repair is what was repaired in the files when the table was opened.
+	repair TableRepair
+
+	// dropped is set (while holding the table's write lock) when the table
+	// is dropped. Its files are closed and moved into the archive dir.
+	dropped bool
+}
+
+// pendingWrite is a write staged by a transaction.
+type pendingWrite struct {
+	data    []byte
+	deleted bool
 }
 
 // close closes the table.
 func (tab *table) close() error {
-	err1 := tab.dataFile.Close()
+	var err1 error
+	for _, f := range tab.dataFiles {
+		if err := f.Close(); err != nil && err1 == nil {
+			err1 = err
+		}
+	}
 	err2 := tab.indexFile.Close()
 	if err1 != nil {
 		return err1
@@ -39,23 +173,110 @@ func (tab *table) close() error {
 	return err2
 }
 
-// readEntry reads a data entry from the file.
+// archiveFiles closes the files of the table and moves them (and its
+// checkpoint, if there is one) into a new archive dir.
+func (tab *table) archiveFiles() error {
+	if err := tab.close(); err != nil {
+		return err
+	}
+	archiveDir, err := newArchiveDir(tab.rootDir, tab.key, "drop")
+	if err != nil {
+		return err
+	}
+
+	paths := []string{
+		filepath.Join(tab.rootDir, string(tab.key)+".index"),
+		checkpointPath(tab.rootDir, tab.key),
+	}
+	for _, n := range slices.Sorted(maps.Keys(tab.dataFiles)) {
+		paths = append(paths, dataFilePath(tab.rootDir, tab.key, n))
+	}
+	for _, path := range paths {
+		err := os.Rename(path, filepath.Join(archiveDir, filepath.Base(path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return syncDir(tab.rootDir)
+}
+
+// isDead returns true if the record is not the current value of a live key
+// (i.e. if it is one of the records punched by DB.PunchDeadRecords).
+func (tab *table) isDead(ir *indexRecord) bool {
+	entry, isLive := tab.liveEntry(ir.key)
+	return !isLive || entry.indexOffset != ir.indexOffset
+}
+
+// isPunched returns true if the data of the record was punched by
+// DB.PunchDeadRecords (i.e. if the record is dead and its data is zeroed but
+// does not match its checksum). Punched records without a checksum cannot be
+// told apart from records whose data is zeroes, so they are never reported.
+func (tab *table) isPunched(ir *indexRecord) (bool, error) {
+	if !ir.hasChecksum || ir.deleted || ir.size == 0 || !tab.isDead(ir) {
+		return false, nil
+	}
+	data := make([]byte, ir.size)
+	if _, err := tab.readEntry(ir, data); err != nil {
+		return false, err
+	}
+	return isZeroed(data) && crc32.Checksum(data, crc32cTable) != ir.checksum, nil
+}
+
+// readEntry reads a data entry from the file. If the entry has a checksum, the
+// data is verified against it.
 func (tab *table) readEntry(entry *indexRecord, buf []byte) (int, error) {
 	if int64(len(buf)) > entry.size {
 		buf = buf[:entry.size]
 	}
 
-	n, err := tab.dataFile.ReadAt(buf, entry.offset)
+	dataFile := tab.dataFiles[entry.dataFile]
+	if dataFile == nil {
+		return 0, fmt.Errorf("data file %d does not exist", entry.dataFile)
+	}
+
+	if entry.hasChecksum && int64(len(buf)) < entry.size {
+		// The checksum covers the entire data, so all of it must be
+		// read.
+		data := make([]byte, entry.size)
+		if _, err := tab.readEntry(entry, data); err != nil {
+			return 0, err
+		}
+		return copy(buf, data), nil
+	}
+
+	n, err := dataFile.ReadAt(buf, entry.offset)
 	if err != nil {
 		return n, fmt.Errorf("failed to read data entry: %v", err)
 	}
 
+	if entry.hasChecksum && !checksumMatches(buf, entry.checksum, tab.isDead(entry)) {
+		return 0, ErrChecksumMismatch{Key: entry.key, DataFile: entry.dataFile,
+			Offset: entry.offset}
+	}
+
 	return n, nil
 }
 
+// liveEntry returns the committed index entry of the key, if it exists and was
+// not deleted.
+func (tab *table) liveEntry(key Key) (*indexRecord, bool) {
+	entry, ok := tab.index[key]
+	if !ok || entry.deleted {
+		return nil, false
+	}
+	return entry, true
+}
+
 // read a data entry from the table into the buffer.
 func (tab *table) read(key Key, buf []byte) (int, error) {
-	entry, ok := tab.index[key]
+	if pw, ok := tab.pending[key]; ok {
+		if pw.deleted {
+			return 0, ErrKeyNotFound{}
+		}
+		return copy(buf, pw.data), nil
+	}
+
+	entry, ok := tab.liveEntry(key)
 	if !ok {
 		return 0, ErrKeyNotFound{}
 	}
@@ -65,18 +286,39 @@ func (tab *table) read(key Key, buf []byte) (int, error) {
 
 // count returns the number of items in the table.
 func (tab *table) count() int {
-	return len(tab.index)
+	n := tab.nbLive
+	for _, key := range tab.pendingOrder {
+		_, wasLive := tab.liveEntry(key)
+		isLive := !tab.pending[key].deleted
+		switch {
+		case isLive && !wasLive:
+			n++
+		case !isLive && wasLive:
+			n--
+		}
+	}
+	return n
 }
 
 // exists returns true if the given key is set in the table.
 func (tab *table) exists(key Key) bool {
-	_, ok := tab.index[key]
+	if pw, ok := tab.pending[key]; ok {
+		return !pw.deleted
+	}
+	_, ok := tab.liveEntry(key)
 	return ok
 }
 
 // get returns the data of the key as a new slice.
 func (tab *table) get(key Key) ([]byte, error) {
-	entry, ok := tab.index[key]
+	if pw, ok := tab.pending[key]; ok {
+		if pw.deleted {
+			return nil, ErrKeyNotFound(key)
+		}
+		return append(make([]byte, 0, len(pw.data)), pw.data...), nil
+	}
+
+	entry, ok := tab.liveEntry(key)
 	if !ok {
 		return nil, ErrKeyNotFound(key)
 	}
@@ -84,7 +326,7 @@ func (tab *table) get(key Key) ([]byte, error) {
 	data := make([]byte, entry.size)
 	n, err := tab.readEntry(entry, data)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read data entry: %v", err)
+		return nil, fmt.Errorf("failed to read data entry: %w", err)
 	}
 	if n != len(data) {
 		return nil, fmt.Errorf("short read: read %d, expected %d", n, len(data))
@@ -93,40 +335,267 @@ func (tab *table) get(key Key) ([]byte, error) {
 	return data, nil
 }
 
-// put appends the data for the specified key to the table. This is NOT safe
-// for concurrent calls.
-func (tab *table) put(key Key, data []byte) error {
+// keysBTreeDegree is the degree of the B-trees of keys of tables.
+const keysBTreeDegree = 32
+
+// newKeysBTree returns a B-tree with the given keys, which must be sorted in
+// lexicographic order.
+func newKeysBTree(sortedKeys []Key) *btree.BTreeG[Key] {
+	keys := btree.NewG(keysBTreeDegree, func(a, b Key) bool {
+		return compareKeys(a, b) < 0
+	})
+	for _, key := range sortedKeys {
+		keys.ReplaceOrInsert(key)
+	}
+	return keys
+}
+
+// allKeys returns an iterator over all keys of the index (including deleted
+// ones), in lexicographic order. The index must not be modified while
+// iterating.
+func (tab *table) allKeys() iter.Seq[Key] {
+	return func(yield func(Key) bool) {
+		tab.keys.Ascend(yield)
+	}
+}
+
+// rangeKeys returns an iterator over the live keys of the table that are in the
+// range [start, end), in lexicographic order. If end is nil, the range has no
+// upper bound.
+//
+// Pending writes are taken into account.
+func (tab *table) rangeKeys(start Key, end *Key) iter.Seq[Key] {
+	inRange := func(key Key) bool {
+		return compareKeys(key, start) >= 0 && (end == nil || compareKeys(key, *end) < 0)
+	}
+
+	return func(yield func(Key) bool) {
+		// Keys written by the current transaction that are not yet in
+		// the index.
+		var newKeys []Key
+		for _, key := range tab.pendingOrder {
+			if _, ok := tab.index[key]; !ok && inRange(key) {
+				newKeys = append(newKeys, key)
+			}
+		}
+		slices.SortFunc(newKeys, compareKeys)
+
+		// Merge with the committed keys. emit returns false when the
+		// iteration must stop.
+		stopped := false
+		emit := func(key Key) bool {
+			switch {
+			case !inRange(key):
+			case !tab.exists(key):
+				return true
+			case yield(key):
+				return true
+			}
+			stopped = true
+			return false
+		}
+		tab.keys.AscendGreaterOrEqual(start, func(key Key) bool {
+			for len(newKeys) > 0 && compareKeys(newKeys[0], key) < 0 {
+				newKey := newKeys[0]
+				newKeys = newKeys[1:]
+				if !emit(newKey) {
+					return false
+				}
+			}
+			return emit(key)
+		})
+		for !stopped && len(newKeys) > 0 {
+			newKey := newKeys[0]
+			newKeys = newKeys[1:]
+			emit(newKey)
+		}
+	}
+}
+
+// TableStats are statistics about the committed contents and files of a
+// table.
+type TableStats struct {
+	// LiveKeys is the number of keys that are not deleted, while Keys also
+	// includes deleted keys.
+	LiveKeys int
+	Keys     int
+
+	// Records is the number of records in the index (i.e. all versions of
+	// all keys).
+	Records int64
+
+	// DataFiles is the number of data files, DataSize their total size and
+	// IndexSize the size of the index.
+	DataFiles int
+	DataSize  int64
+	IndexSize int64
+}
+
+// stats returns the statistics of the table.
+func (tab *table) stats() (TableStats, error) {
+	st := TableStats{
+		LiveKeys:  tab.nbLive,
+		Keys:      tab.keys.Len(),
+		Records:   (tab.indexSize - tab.indexStart) / tab.irSize,
+		DataFiles: len(tab.dataFiles),
+		IndexSize: tab.indexSize,
+	}
+	for _, f := range tab.dataFiles {
+		stat, err := f.Stat()
+		if err != nil {
+			return st, err
+		}
+		st.DataSize += stat.Size()
+	}
+	return st, nil
+}
+
+// createDataFile creates a new data file (which must not exist) and writes its
+// header.
+func createDataFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := initFile(f, dataFileMagic, dataFormatVersion); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return f, nil
+}
+
+// rotateDataFile syncs the current data file and starts a new one. Previous
+// data files are never written to again.
+func (tab *table) rotateDataFile() error {
+	if err := tab.dataFile.Sync(); err != nil {
+		return fmt.Errorf("error fsyncing data table: %v", err)
+	}
+
+	n := tab.curDataFile + 1
+	f, err := createDataFile(dataFilePath(tab.rootDir, tab.key, n))
+	if err != nil {
+		return err
+	}
+
+	tab.dataFiles[n] = f
+	tab.dataFile = f
+	tab.curDataFile = n
+	tab.dataEnds[n] = fileHeaderSize
+	return nil
+}
+
+// appendData appends the data and the record separator for the specified key
+// to the current data file, starting a new data file if the current one would
+// grow past the maximum data file size. It returns the number of the data file
+// and the offset of the data in it. The data file is NOT synced.
+//
+// Tombstones are written as empty data, with the tombstone marker after the
+// key.
+func (tab *table) appendData(key Key, data []byte, deleted bool) (uint32, int64, error) {
 	// Encode the key into the temp buffer (separator is already there).
 	hex.Encode(tab.sepBuffer[recordSeparatorSize:], key[:])
+	padding := tab.sepBuffer[recordSeparatorSize+KeySize*2:]
+	if deleted {
+		copy(padding, tombstoneMarker)
+	} else {
+		for i := range padding {
+			padding[i] = lfChar
+		}
+	}
 
 	// Get current end of data file to determine offset
 	offset, err := tab.dataFile.Seek(0, io.SeekEnd)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
-	// Get current end of index file to determine index offset
-	indexOffset, err := tab.indexFile.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
+	// Start a new data file if needed (unless the current one does not
+	// have any records yet).
+	recordSize := int64(len(data) + len(tab.sepBuffer))
+	maxSize := tab.opts.maxDataFileSize
+	if maxSize > 0 && offset > fileHeaderSize && offset+recordSize > maxSize {
+		if err := tab.rotateDataFile(); err != nil {
+			return 0, 0, err
+		}
+		offset = fileHeaderSize
 	}
 
 	// Write the data.
 	n, err := tab.dataFile.Write(data)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	if n != len(data) {
-		return errors.New("short write")
+		return 0, 0, errors.New("short write")
 	}
 
 	// Write the separator.
 	n, err = tab.dataFile.Write(tab.sepBuffer)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	if n != len(tab.sepBuffer) {
-		return errors.New("short write")
+		return 0, 0, errors.New("short write")
+	}
+
+	return tab.curDataFile, offset, nil
+}
+
+// newRecord returns a new index record for the key and its data, chained to its
+// current entry in the index (if there is one). The record's index line will be
+// written at indexOffset.
+func (tab *table) newRecord(key Key, dataFile uint32, offset int64, data []byte, deleted bool, indexOffset int64) indexRecord {
+	ir := indexRecord{
+		dataFile:        dataFile,
+		key:             key,
+		offset:          offset,
+		size:            int64(len(data)),
+		prevIndexOffset: math.MaxInt64,
+		indexOffset:     indexOffset,
+		deleted:         deleted,
+		hasChecksum:     tab.irSize == indexRecordSize,
+	}
+	if ir.hasChecksum {
+		ir.checksum = crc32.Checksum(data, crc32cTable)
+	}
+	if entry := tab.index[key]; entry != nil {
+		ir.prevIndexOffset = entry.indexOffset
+	}
+	return ir
+}
+
+// setEntry sets the in-memory index entry of the record's key.
+func (tab *table) setEntry(ir indexRecord) {
+	if end := ir.offset + ir.size + recordTrailerSize; end > tab.dataEnds[ir.dataFile] {
+		tab.dataEnds[ir.dataFile] = end
+	}
+	entry := tab.index[ir.key]
+	if entry == nil {
+		entry = new(indexRecord)
+		tab.index[ir.key] = entry
+		tab.keys.ReplaceOrInsert(ir.key)
+	} else if !entry.deleted {
+		tab.nbLive--
+	}
+	*entry = ir
+	if !ir.deleted {
+		tab.nbLive++
+	}
+}
+
+// put appends the data for the specified key to the table. This is NOT safe
+// for concurrent calls.
+//
+// The data and index files are written and synced immediately (i.e. this does
+// not go through the WAL).
+func (tab *table) put(key Key, data []byte) error {
+	if err := tab.checkSeparatorCollision(key, data); err != nil {
+		return err
+	}
+	dataFile, offset, err := tab.appendData(key, data, false)
+	if err != nil {
+		return err
 	}
 
 	// Commit.
@@ -134,37 +603,141 @@ func (tab *table) put(key Key, data []byte) error {
 		return fmt.Errorf("error fsyncing data table: %v", err)
 	}
 
-	// Store entry in memory index
-	var entry *indexRecord
-	if entry = tab.index[key]; entry == nil {
-		entry = &indexRecord{
-			key:             key,
-			offset:          offset,
-			size:            int64(len(data)),
-			prevIndexOffset: math.MaxInt64,
-			indexOffset:     indexOffset,
-		}
-		tab.index[key] = entry
-	} else {
-		entry.offset = offset
-		entry.size = int64(len(data))
-		entry.prevIndexOffset = entry.indexOffset
-		entry.indexOffset = indexOffset
-	}
-
 	// Append entry to indexFile.
-	irBuf := tab.irw.writeEntry(entry)
-	_, err = tab.indexFile.Write(irBuf)
+	ir := tab.newRecord(key, dataFile, offset, data, false, tab.indexSize)
+	irBuf := tab.irw.writeEntry(&ir)
+	_, err = tab.indexFile.WriteAt(irBuf, tab.indexSize)
 	if err != nil {
 		return fmt.Errorf("error while writing index record: %v", err)
 	}
 	if err := tab.indexFile.Sync(); err != nil {
 		return fmt.Errorf("error fsyncing index table: %v", err)
 	}
+	tab.indexSize += int64(len(irBuf))
+
+	// Store entry in memory index
+	tab.setEntry(ir)
 
 	return nil // Indicate success
 }
 
+// stage stages a write for the specified key, to be written when the current
+// transaction is committed. This is NOT safe for concurrent calls.
+func (tab *table) stage(key Key, pw pendingWrite) {
+	if tab.pending == nil {
+		tab.pending = make(map[Key]pendingWrite)
+	}
+	if _, ok := tab.pending[key]; !ok {
+		tab.pendingOrder = append(tab.pendingOrder, key)
+	}
+	tab.pending[key] = pw
+}
+
+// checkSeparatorCollision returns ErrSeparatorCollision if separator collision
+// checks are enabled and the data contains the separator, either entirely or
+// across its end (i.e. the data ends with bytes that, followed by the separator
+// written after it, contain the separator earlier than the end of the data).
+func (tab *table) checkSeparatorCollision(key Key, data []byte) error {
+	if !tab.opts.separatorCollisionCheck {
+		return nil
+	}
+	sep := tab.sepBuffer[:recordSeparatorSize]
+	tail := data[max(0, len(data)-(recordSeparatorSize-1)):]
+	if bytes.Contains(data, sep) || bytes.Index(append(slices.Clone(tail), sep...), sep) < len(tail) {
+		return ErrSeparatorCollision{Table: tab.key, Key: key}
+	}
+	return nil
+}
+
+// stagePut stages the data for the specified key, to be written when the
+// current transaction is committed. The data is copied. This is NOT safe for
+// concurrent calls.
+func (tab *table) stagePut(key Key, data []byte) {
+	tab.stage(key, pendingWrite{data: append(make([]byte, 0, len(data)), data...)})
+}
+
+// stageDelete stages a tombstone for the specified key, to be written when
+// the current transaction is committed. This is NOT safe for concurrent calls.
+func (tab *table) stageDelete(key Key) {
+	tab.stage(key, pendingWrite{deleted: true})
+}
+
+// hasPending returns true if there are pending (i.e. staged but not yet
+// committed) writes in the table.
+func (tab *table) hasPending() bool {
+	return len(tab.pendingOrder) > 0
+}
+
+// prepareCommit appends the data of all pending writes to the data file and
+// encodes their index records. It returns the encoded index records, which
+// must be committed to the WAL before calling applyCommit.
+//
+// The data file is NOT synced and the in-memory index is NOT modified.
+func (tab *table) prepareCommit() ([]byte, error) {
+	tab.walBuf = tab.walBuf[:0]
+	tab.prepared = tab.prepared[:0]
+	tab.preparedFrom = tab.curDataFile
+	for _, key := range tab.pendingOrder {
+		pw := tab.pending[key]
+		if _, isLive := tab.liveEntry(key); pw.deleted && !isLive {
+			// Nothing to delete.
+			continue
+		}
+
+		dataFile, offset, err := tab.appendData(key, pw.data, pw.deleted)
+		if err != nil {
+			return nil, err
+		}
+
+		indexOffset := tab.indexSize + int64(len(tab.walBuf))
+		ir := tab.newRecord(key, dataFile, offset, pw.data, pw.deleted, indexOffset)
+		tab.prepared = append(tab.prepared, ir)
+		tab.walBuf = append(tab.walBuf, tab.irw.writeEntry(&ir)...)
+	}
+	return tab.walBuf, nil
+}
+
+// applyCommit writes the index records prepared by prepareCommit to the index
+// file and updates the in-memory index. This must only be called after the
+// prepared records have been committed to the WAL.
+func (tab *table) applyCommit() error {
+	_, err := tab.indexFile.WriteAt(tab.walBuf, tab.indexSize)
+	if err != nil {
+		return fmt.Errorf("error while writing index records: %v", err)
+	}
+	if err := tab.indexFile.Sync(); err != nil {
+		return fmt.Errorf("error fsyncing index table: %v", err)
+	}
+	tab.indexSize += int64(len(tab.walBuf))
+
+	for _, ir := range tab.prepared {
+		tab.setEntry(ir)
+	}
+
+	tab.discardPending()
+	return nil
+}
+
+// truncatePrepared truncates the data files appended to by prepareCommit back
+// to the end of their last indexed record, discarding the data of a commit that
+// failed before it was committed to the WAL.
+func (tab *table) truncatePrepared() error {
+	for n := tab.preparedFrom; n <= tab.curDataFile; n++ {
+		if err := tab.dataFiles[n].Truncate(tab.dataEnds[n]); err != nil {
+			return fmt.Errorf("error truncating data file %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// discardPending discards all pending writes.
+func (tab *table) discardPending() {
+	clear(tab.pending)
+	tab.pendingOrder = tab.pendingOrder[:0]
+	tab.prepared = tab.prepared[:0]
+	tab.walBuf = tab.walBuf[:0]
+}
+
 // rangeRevEntries ranges over the entries of a key in reverse order (most
 // recent values first).
 //
@@ -178,7 +751,7 @@ func (tab *table) rangeRevEntries(key Key, f func(indexRecord) error) error {
 
 	// Copy the value.
 	ir := *entry
-	var indexReadBuf = make([]byte, indexRecordSize)
+	var indexReadBuf = make([]byte, tab.irSize)
 
 	// Iterate.
 	for {
@@ -191,11 +764,12 @@ func (tab *table) rangeRevEntries(key Key, f func(indexRecord) error) error {
 			return nil
 		}
 
-		n, err := tab.indexFile.ReadAt(indexReadBuf, ir.prevIndexOffset)
+		indexOffset := ir.prevIndexOffset
+		n, err := tab.indexFile.ReadAt(indexReadBuf, indexOffset)
 		if err != nil {
 			return err
 		}
-		if n != indexRecordSize {
+		if n != len(indexReadBuf) {
 			return errors.New("short read")
 		}
 
@@ -203,60 +777,188 @@ func (tab *table) rangeRevEntries(key Key, f func(indexRecord) error) error {
 		if err != nil {
 			return err
 		}
+		ir.indexOffset = indexOffset
 	}
 }
 
-// newTable creates or opens an existing table.
-func newTable(rootDir string, tableName TableKey, recSep recordSeparator) (*table, error) {
-	// TODO: lock files?
+// openDataFiles opens all data files of a table. Only the last one is opened
+// for writing (unless readOnly is true). If the table has no data files, the
+// first one is created (again, unless readOnly is true) and its header is
+// written.
+func openDataFiles(rootDir string, tableName TableKey, readOnly bool) (map[uint32]*os.File, uint32, error) {
+	nums, err := listDataFiles(rootDir, tableName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(nums) == 0 {
+		nums = []uint32{0}
+	}
+
+	files := make(map[uint32]*os.File, len(nums))
+	for i, n := range nums {
+		flag := os.O_RDONLY
+		if i == len(nums)-1 && !readOnly {
+			flag = os.O_RDWR | os.O_CREATE
+		}
+		f, err := os.OpenFile(dataFilePath(rootDir, tableName, n), flag, 0666)
+		if err == nil && flag != os.O_RDONLY {
+			err = initFile(f, dataFileMagic, dataFormatVersion)
+			if err != nil {
+				f.Close()
+			}
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, 0, err
+		}
+		files[n] = f
+	}
+	return files, nums[len(nums)-1], nil
+}
 
+// newTable creates or opens an existing table.
+func newTable(rootDir string, tableName TableKey, recSep recordSeparator, opts tableOptions) (*table, error) {
 	// Open the files.
-	dataPath := filepath.Join(rootDir, string(tableName)+".data")
-	dataFile, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0666)
+	dataFiles, curDataFile, err := openDataFiles(rootDir, tableName, opts.readOnly)
 	if err != nil {
 		return nil, err
 	}
 
 	indexPath := filepath.Join(rootDir, string(tableName)+".index")
-	indexFile, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0666)
+	indexFlag := os.O_RDWR | os.O_CREATE
+	if opts.readOnly {
+		indexFlag = os.O_RDONLY
+	}
+	indexFile, err := os.OpenFile(indexPath, indexFlag, 0666)
 	if err != nil {
-		dataFile.Close() // Close dataFile if indexFile fails to open
+		// Close data files if indexFile fails to open
+		for _, f := range dataFiles {
+			f.Close()
+		}
 		return nil, err
 	}
 
-	// Read the index into memory.
+	closeFiles := func() {
+		indexFile.Close()
+		for _, f := range dataFiles {
+			f.Close()
+		}
+	}
+
+	// Indexes written by older versions keep their format until the table
+	// is compacted, except for those that must be upgraded first.
+	if !opts.readOnly {
+		if err := initFile(indexFile, indexFileMagic, indexFormatVersion); err != nil {
+			closeFiles()
+			return nil, err
+		}
+	}
+	format, err := readIndexFormat(indexFile)
+	if err == nil && format.version == indexFormatV1 {
+		err = ErrUpgradeRequired{File: indexPath}
+	}
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+
+	// Read the index into memory, tracking the end of the last indexed
+	// record of each data file. If there is a valid checkpoint, only the
+	// records after it are read. Otherwise (e.g. if the checkpoint does not
+	// match the index), the entire index is read.
 	index := make(map[Key]*indexRecord)
+	dataEnds := make(map[uint32]int64, len(dataFiles))
+	indexOffset := format.start
+	var nbLive int
+	if cp, err := loadCheckpoint(rootDir, tableName, indexFile, format); err == nil && cp != nil {
+		index, dataEnds, indexOffset = cp.index, cp.dataEnds, cp.indexOffset
+		for _, entry := range index {
+			if !entry.deleted {
+				nbLive++
+			}
+		}
+	}
+	checkpointOffset := indexOffset
+	for n, f := range dataFiles {
+		if _, ok := dataEnds[n]; ok {
+			continue
+		}
+		if dataEnds[n], err = readDataFileStart(f); err != nil {
+			closeFiles()
+			return nil, err
+		}
+	}
+	if _, err := indexFile.Seek(indexOffset, io.SeekStart); err != nil {
+		closeFiles()
+		return nil, err
+	}
 	indexReader := bufio.NewReader(indexFile)
-	irBuf := make([]byte, indexRecordSize)
-	var indexOffset int64
-	for i := 0; ; i++ {
-		var n int
-		_, err = io.ReadFull(indexReader, irBuf)
+	irBuf := make([]byte, format.recordSize)
+	for {
+		n, err := io.ReadFull(indexReader, irBuf)
 		if err != nil {
 			break
 		}
 
 		entry := new(indexRecord)
 		if err := entry.decode(irBuf); err != nil {
-			return nil, fmt.Errorf("error reading index entry %d: %v", i, err)
+			closeFiles()
+			return nil, fmt.Errorf("error reading index entry at offset %d: %v",
+				indexOffset, err)
 		}
 		entry.indexOffset, indexOffset = indexOffset, indexOffset+int64(n)
+		if end := entry.offset + entry.size + recordTrailerSize; end > dataEnds[entry.dataFile] {
+			dataEnds[entry.dataFile] = end
+		}
 
+		if prev := index[entry.key]; prev != nil && !prev.deleted {
+			nbLive--
+		}
+		if !entry.deleted {
+			nbLive++
+		}
 		index[entry.key] = entry
 	}
+	keys := newKeysBTree(slices.SortedFunc(maps.Keys(index), compareKeys))
 
-	sepBuffer := make([]byte, KeySize*2+recordSeparatorSize+8) // +8 padding
+	sepBuffer := make([]byte, KeySize*2+recordSeparatorSize+recordPaddingSize)
 	for i := range sepBuffer {
 		sepBuffer[i] = lfChar
 	}
 	copy(sepBuffer, recSep[:])
 
-	return &table{
-		key:       tableName,
-		dataFile:  dataFile,
-		indexFile: indexFile,
-		index:     index,
-		sepBuffer: sepBuffer,
-		irw:       newIndexRecordWriter(),
-	}, nil
+	tab := &table{
+		key:         tableName,
+		rootDir:     rootDir,
+		opts:        opts,
+		dataFiles:   dataFiles,
+		dataFile:    dataFiles[curDataFile],
+		curDataFile: curDataFile,
+		dataEnds:    dataEnds,
+		indexFile:   indexFile,
+		index:       index,
+		keys:        keys,
+		indexSize:   indexOffset,
+		nbLive:      nbLive,
+		sepBuffer:   sepBuffer,
+		irw:         newIndexRecordWriter(format.recordSize),
+		irSize:      format.recordSize,
+		indexStart:  format.start,
+
+		checkpointOffset: checkpointOffset,
+	}
+
+	// Remove anything left after the committed parts of the files (by a
+	// crash while committing). In read-only mode, these may be writes in
+	// progress by another process.
+	if opts.readOnly {
+		return tab, nil
+	}
+	if err := tab.repairTails(dataEnds); err != nil {
+		closeFiles()
+		return nil, fmt.Errorf("error repairing files of table %q: %v", tableName, err)
+	}
+	return tab, nil
 }
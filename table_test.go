@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"math/rand/v2"
+	"os"
 	"slices"
 	"testing"
 
@@ -18,7 +19,7 @@ func TestTableCorrectness(t *testing.T) {
 	rootDir := t.TempDir()
 	tableName := TableKey("test")
 
-	tab, err := newTable(rootDir, tableName, testRecSeparator)
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	require.NoError(t, err)
 
 	// Write values.
@@ -54,12 +55,19 @@ func TestTableCorrectness(t *testing.T) {
 		}
 	}
 
+	// Keys are kept in order, both when written and when read from the
+	// index.
+	sortedKeys := slices.SortedFunc(slices.Values(keys), compareKeys)
+	sortedKeys = slices.Compact(sortedKeys)
+	require.Equal(t, sortedKeys, slices.Collect(tab.allKeys()))
+
 	// Close the table.
 	require.NoError(t, tab.close())
 
 	// Reopen.
-	tab, err = newTable(rootDir, tableName, testRecSeparator)
+	tab, err = newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	require.NoError(t, err)
+	require.Equal(t, sortedKeys, slices.Collect(tab.allKeys()))
 
 	// Read random values.
 	for range MAXVALUES * 4 {
@@ -90,7 +98,7 @@ func TestTabRangeRevEntries(t *testing.T) {
 	rootDir := t.TempDir()
 	tableName := TableKey("test")
 
-	tab, err := newTable(rootDir, tableName, testRecSeparator)
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	require.NoError(t, err)
 
 	// Write a bunch of values.
@@ -144,8 +152,164 @@ func TestTabRangeRevEntries(t *testing.T) {
 
 		// Close and reopen for next iteration.
 		require.NoError(t, tab.close())
-		tab, err = newTable(rootDir, tableName, testRecSeparator)
+		tab, err = newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+		require.NoError(t, err)
+	}
+}
+
+// TestTableDataFileRotation tests that tables start new data files once the
+// current one reaches the maximum data file size.
+func TestTableDataFileRotation(t *testing.T) {
+	const MAXVALUES = 100
+	const MAXVALUESIZE = 1024
+	const MAXDATAFILESIZE = 8192
+
+	rootDir := t.TempDir()
+	tableName := TableKey("test")
+	opts := tableOptions{maxDataFileSize: MAXDATAFILESIZE}
+
+	tab, err := newTable(rootDir, tableName, testRecSeparator, opts)
+	require.NoError(t, err)
+
+	// Write values.
+	rngReader := rand.NewChaCha8([32]byte{})
+	keys := make([]Key, MAXVALUES)
+	values := make(map[Key][]byte)
+	for i := range MAXVALUES {
+		rngReader.Read(keys[i][:])
+		value := make([]byte, rand.IntN(MAXVALUESIZE))
+		rngReader.Read(value)
+		require.NoError(t, tab.put(keys[i], value))
+		values[keys[i]] = value
+	}
+
+	// Multiple data files must have been created, none of them larger than
+	// the maximum size.
+	dataFiles, err := listDataFiles(rootDir, tableName)
+	require.NoError(t, err)
+	require.Greater(t, len(dataFiles), 1)
+	require.Equal(t, tab.curDataFile, dataFiles[len(dataFiles)-1])
+	sizes := make(map[uint32]int64)
+	for _, n := range dataFiles {
+		stat, err := os.Stat(dataFilePath(rootDir, tableName, n))
+		require.NoError(t, err)
+		require.LessOrEqual(t, stat.Size(), int64(MAXDATAFILESIZE))
+		sizes[n] = stat.Size()
+	}
+
+	// Reopen and read all values.
+	require.NoError(t, tab.close())
+	tab, err = newTable(rootDir, tableName, testRecSeparator, opts)
+	require.NoError(t, err)
+	defer tab.close()
+	for _, key := range keys {
+		v, err := tab.get(key)
+		require.NoError(t, err)
+		require.Equal(t, values[key], v)
+	}
+
+	// Writing more values does not modify older data files.
+	rngReader.Read(keys[0][:])
+	require.NoError(t, tab.put(keys[0], make([]byte, MAXVALUESIZE)))
+	for _, n := range dataFiles[:len(dataFiles)-1] {
+		stat, err := os.Stat(dataFilePath(rootDir, tableName, n))
+		require.NoError(t, err)
+		require.Equal(t, sizes[n], stat.Size())
+	}
+}
+
+// TestTableChecksums tests that corrupted data is detected through the
+// checksums of index records.
+func TestTableChecksums(t *testing.T) {
+	rootDir := t.TempDir()
+	tableName := TableKey("test")
+
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+	require.NoError(t, err)
+	defer func() { tab.close() }()
+	require.Equal(t, int64(indexRecordSize), tab.irSize)
+
+	key1, key2 := keyFromInt(1), keyFromInt(2)
+	value := bytes.Repeat([]byte{0x55}, 100)
+	require.NoError(t, tab.put(key1, value))
+	require.NoError(t, tab.put(key2, value))
+
+	// Corrupt the data of the first key.
+	ir := tab.index[key1]
+	require.True(t, ir.hasChecksum)
+	dataPath := dataFilePath(rootDir, tableName, ir.dataFile)
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	data[ir.offset+int64(len(value))-1] ^= 0xff
+	require.NoError(t, os.WriteFile(dataPath, data, 0o600))
+
+	// Reads of the first key fail, even when only part of the data is read,
+	// while the second key is intact.
+	_, err = tab.get(key1)
+	require.ErrorIs(t, err, ErrChecksumMismatch{})
+	_, err = tab.read(key1, make([]byte, 10))
+	require.ErrorIs(t, err, ErrChecksumMismatch{})
+	got, err := tab.get(key2)
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+
+	// Checksums are kept when reopening the table.
+	require.NoError(t, tab.close())
+	tab, err = newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+	require.NoError(t, err)
+	_, err = tab.get(key1)
+	require.ErrorIs(t, err, ErrChecksumMismatch{})
+}
+
+// TestTableIndexWithoutChecksums tests that index files written in the format
+// without checksums can still be used, and are upgraded by compaction.
+func TestTableIndexWithoutChecksums(t *testing.T) {
+	const NBKEYS = 10
+
+	rootDir := t.TempDir()
+	tableName := TableKey("test")
+	value := func(k int) []byte { return bytes.Repeat([]byte{byte(k)}, k+1) }
+
+	// Write the index as older versions did (without a header).
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+	require.NoError(t, err)
+	require.NoError(t, tab.indexFile.Truncate(0))
+	tab.irw, tab.irSize = newIndexRecordWriter(indexRecordSizeV2), indexRecordSizeV2
+	tab.indexStart, tab.indexSize = 0, 0
+	for k := range NBKEYS / 2 {
+		require.NoError(t, tab.put(keyFromInt(k), value(k)))
+	}
+	require.NoError(t, tab.close())
+
+	// The format is kept when reopening and writing more records.
+	tab, err = newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+	require.NoError(t, err)
+	defer func() { tab.close() }()
+	require.Equal(t, int64(indexRecordSizeV2), tab.irSize)
+	for k := NBKEYS / 2; k < NBKEYS; k++ {
+		require.NoError(t, tab.put(keyFromInt(k), value(k)))
+	}
+	require.Equal(t, int64(NBKEYS*indexRecordSizeV2), tab.indexSize)
+	for k := range NBKEYS {
+		require.False(t, tab.index[keyFromInt(k)].hasChecksum)
+		got, err := tab.get(keyFromInt(k))
+		require.NoError(t, err)
+		require.Equal(t, value(k), got)
+	}
+
+	// Compacting rewrites the index in the current format.
+	require.NoError(t, tab.compact(0))
+	require.Equal(t, int64(indexRecordSize), tab.irSize)
+	require.NoError(t, tab.close())
+	tab, err = newTable(rootDir, tableName, testRecSeparator, tableOptions{})
+	require.NoError(t, err)
+	require.Equal(t, int64(indexRecordSize), tab.irSize)
+	require.Equal(t, int64(fileHeaderSize+NBKEYS*indexRecordSize), tab.indexSize)
+	for k := range NBKEYS {
+		require.True(t, tab.index[keyFromInt(k)].hasChecksum)
+		got, err := tab.get(keyFromInt(k))
 		require.NoError(t, err)
+		require.Equal(t, value(k), got)
 	}
 }
 
@@ -156,7 +320,7 @@ func BenchmarkTablePutSameKey(b *testing.B) {
 	rootDir := b.TempDir()
 	tableName := TableKey("test")
 
-	tab, err := newTable(rootDir, tableName, testRecSeparator)
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -181,7 +345,7 @@ func BenchmarTablekDiffKey(b *testing.B) {
 	rootDir := b.TempDir()
 	tableName := TableKey("test")
 
-	tab, err := newTable(rootDir, tableName, testRecSeparator)
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -208,7 +372,7 @@ func BenchmarkRead(b *testing.B) {
 	rootDir := b.TempDir()
 	tableName := TableKey("test")
 
-	tab, err := newTable(rootDir, tableName, testRecSeparator)
+	tab, err := newTable(rootDir, tableName, testRecSeparator, tableOptions{})
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -1,10 +1,11 @@
 package simplewaldb
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"iter"
 	"sort"
-	"sync"
 )
 
 // txTableCfg holds the config for a single table transaction.
@@ -12,7 +13,25 @@ type txTableCfg struct {
 	table    *table
 	key      TableKey
 	writable bool
-	lock     *sync.RWMutex
+	lock     *tableLock
+}
+
+// release the lock of the table.
+func (tc *txTableCfg) release() {
+	if tc.writable {
+		tc.lock.Unlock()
+	} else {
+		tc.lock.RUnlock()
+	}
+}
+
+// acquireContext acquires the lock of the table (for writing or only for
+// reading), giving up when ctx is done first.
+func (tc *txTableCfg) acquireContext(ctx context.Context) error {
+	if tc.writable {
+		return tc.lock.lockContext(ctx)
+	}
+	return tc.lock.rLockContext(ctx)
 }
 
 // TxConfig defines a prepared tx configuration.
@@ -22,23 +41,43 @@ type TxConfig struct {
 	tables    map[TableKey]*txTableCfg
 }
 
-// RunTx runs the given function as a transaction. It ends the transaction after
-// f returns.
+// RunTx runs the given function as a transaction. The transaction is committed
+// after f returns. If f returns an error or panics, or an error was recorded in
+// the transaction (see Tx.Err) even if f ignored it, the transaction is rolled
+// back instead.
 //
 // The transaction reference passed in the function is NOT safe for concurrent
-// access and MUST NOT be kept after f returns.
+// access and MUST NOT be kept after f returns. f MUST NOT call Commit() or
+// Rollback() on it.
 func (txc *TxConfig) RunTx(f func(tx Tx) error) error {
-	tx, err := txc.db.BeginTx(txc)
+	return txc.RunTxContext(context.Background(), f)
+}
+
+// RunTxContext is like RunTx, but gives up waiting for the locks of the tables
+// of the transaction when ctx is done (see DB.BeginTxContext). Once the
+// transaction has begun, ctx is not used.
+func (txc *TxConfig) RunTxContext(ctx context.Context, f func(tx Tx) error) error {
+	tx, err := txc.db.BeginTxContext(ctx, txc)
 	if err != nil {
 		return err
 	}
 
-	err = f(tx)
-	endErr := txc.db.EndTx(&tx)
-	if err != nil {
+	defer func() {
+		if !tx.done {
+			// f panicked.
+			_ = tx.Rollback()
+		}
+	}()
+
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
 		return err
 	}
-	return endErr
+	if err := tx.Err(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
 }
 
 // TxTable is a table obtained within the context of a transaction. Operations
@@ -56,6 +95,9 @@ func (tt *TxTable) IsWritable() bool {
 
 // Read a record from the table into the buffer. This reads at most len(buf)
 // bytes from the entry, therefore the buffer should be sized appropriately.
+//
+// If the record has a checksum, the entire record is read to verify it, and
+// ErrChecksumMismatch is returned if its data is corrupted.
 func (tt *TxTable) Read(key Key, buf []byte) (int, error) {
 	return tt.tab.read(key, buf)
 }
@@ -73,8 +115,13 @@ func (tt *TxTable) Get(key Key) ([]byte, error) {
 
 // Put a record into the table.
 //
-// NOTE: Put calls are immediately written to the filesystem. The DB does NOT
-// support atomicity across multiple tables within a transaction.
+// The record is only written to the filesystem when the transaction is
+// committed, but is visible to reads done within the transaction. All Puts
+// done within a transaction (across all of its tables) are committed
+// atomically.
+//
+// If the DB was opened with WithSeparatorCollisionCheck, values that contain the
+// separator are rejected with ErrSeparatorCollision.
 func (tt *TxTable) Put(key Key, data []byte) error {
 	if tt.tx.done {
 		return ErrTxDone
@@ -82,8 +129,182 @@ func (tt *TxTable) Put(key Key, data []byte) error {
 	if !tt.writable {
 		return ErrTableNotWritableInTx(tt.tab.key)
 	}
+	if err := tt.tab.checkSeparatorCollision(key, data); err != nil {
+		return err
+	}
+
+	tt.tab.stagePut(key, data)
+	return nil
+}
+
+// Delete a record from the table.
+//
+// Deletion appends a tombstone record for the key, so previous values of the
+// key remain in the table's history. Deleting a key that does not exist is a
+// no-op.
+func (tt *TxTable) Delete(key Key) error {
+	if tt.tx.done {
+		return ErrTxDone
+	}
+	if !tt.writable {
+		return ErrTableNotWritableInTx(tt.tab.key)
+	}
 
-	return tt.tab.put(key, data)
+	tt.tab.stageDelete(key)
+	return nil
+}
+
+// Version is a version of a record, as stored in a table.
+type Version struct {
+	// Data is the data of the record. This is nil for deletions.
+	Data []byte
+
+	// Size is the size of the data.
+	Size int64
+
+	// Deleted is true if this version is a tombstone (i.e. the key was
+	// deleted).
+	Deleted bool
+
+	// DataFile and Offset are the data file and offset in it where the data
+	// is stored.
+	DataFile uint32
+	Offset   int64
+
+	// IndexOffset is the offset of the record's line in the index file.
+	IndexOffset int64
+}
+
+// errStopIter is used to stop ranging when an iterator's yield returns false.
+var errStopIter = errors.New("stop iteration")
+
+// History returns an iterator over all committed versions of the given key,
+// from the most recent to the oldest one. Iteration stops after the first
+// error.
+//
+// The iterator is only valid while the transaction is active.
+func (tt *TxTable) History(key Key) iter.Seq2[Version, error] {
+	return func(yield func(Version, error) bool) {
+		if tt.tx.done {
+			yield(Version{}, ErrTxDone)
+			return
+		}
+
+		err := tt.tab.rangeRevEntries(key, func(ir indexRecord) error {
+			v := Version{
+				Size:        ir.size,
+				Deleted:     ir.deleted,
+				DataFile:    ir.dataFile,
+				Offset:      ir.offset,
+				IndexOffset: ir.indexOffset,
+			}
+			if !ir.deleted {
+				v.Data = make([]byte, ir.size)
+				n, err := tt.tab.readEntry(&ir, v.Data)
+				if err != nil {
+					return err
+				}
+				if n != len(v.Data) {
+					return fmt.Errorf("short read: read %d, expected %d", n, len(v.Data))
+				}
+			}
+			if !yield(v, nil) {
+				return errStopIter
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIter) {
+			yield(Version{}, err)
+		}
+	}
+}
+
+// Keys returns an iterator over the keys of the table, in lexicographic order.
+//
+// The iterator is only valid while the transaction is active.
+func (tt *TxTable) Keys() iter.Seq[Key] {
+	if tt.tx.done {
+		return func(func(Key) bool) {}
+	}
+	return tt.tab.rangeKeys(emptyKey, nil)
+}
+
+// withValues returns an iterator over the given keys and their values. If
+// reading a value fails, iteration stops and the error is recorded in the
+// transaction (see Tx.Err()).
+func (tt *TxTable) withValues(keys iter.Seq[Key]) iter.Seq2[Key, []byte] {
+	return func(yield func(Key, []byte) bool) {
+		if tt.tx.done {
+			return
+		}
+		for key := range keys {
+			v, err := tt.tab.get(key)
+			if err != nil {
+				tt.tx.setErr(err)
+				return
+			}
+			if !yield(key, v) {
+				return
+			}
+		}
+	}
+}
+
+// All returns an iterator over the keys and values of the table, in
+// lexicographic order of keys.
+//
+// If reading a value fails, iteration stops and the error is recorded in the
+// transaction (see Tx.Err()). The iterator is only valid while the transaction
+// is active.
+func (tt *TxTable) All() iter.Seq2[Key, []byte] {
+	return tt.withValues(tt.tab.rangeKeys(emptyKey, nil))
+}
+
+// Range returns an iterator over the keys (and their values) of the table that
+// are in the range [start, end), in lexicographic order. If end is the zero
+// key, the range has no upper bound.
+//
+// If reading a value fails, iteration stops and the error is recorded in the
+// transaction (see Tx.Err()). The iterator is only valid while the transaction
+// is active.
+func (tt *TxTable) Range(start, end Key) iter.Seq2[Key, []byte] {
+	if end == emptyKey {
+		return tt.withValues(tt.tab.rangeKeys(start, nil))
+	}
+	return tt.withValues(tt.tab.rangeKeys(start, &end))
+}
+
+// Prefix returns an iterator over the keys (and their values) of the table
+// that start with the given prefix, in lexicographic order. No key starts with
+// a prefix longer than KeySize, so the iterator is empty in that case.
+//
+// If reading a value fails, iteration stops and the error is recorded in the
+// transaction (see Tx.Err()). The iterator is only valid while the transaction
+// is active.
+func (tt *TxTable) Prefix(prefix []byte) iter.Seq2[Key, []byte] {
+	return tt.withValues(tt.PrefixKeys(prefix))
+}
+
+// PrefixKeys is like Prefix, but only iterates over the keys (without reading
+// their values).
+func (tt *TxTable) PrefixKeys(prefix []byte) iter.Seq[Key] {
+	if tt.tx.done || len(prefix) > KeySize {
+		return func(func(Key) bool) {}
+	}
+
+	var start, end Key
+	copy(start[:], prefix)
+	copy(end[:], prefix)
+
+	// The end of the range is the prefix incremented by one. If the prefix
+	// is all 0xff, there is no upper bound.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return tt.tab.rangeKeys(start, &end)
+		}
+	}
+	return tt.tab.rangeKeys(start, nil)
 }
 
 // Count returns the number of items in the table.
@@ -110,18 +331,52 @@ func (tt *TxTable) Count() (int, error) {
 // single error check at the end.
 type Tx struct {
 	done bool
-	err  error
 	cfg  *TxConfig
+
+	// err points to the first error recorded by the transaction. It is
+	// shared by all copies of the Tx (such as the one passed to the function
+	// run by RunTx), so that errors recorded in any of them cause the
+	// transaction to be rolled back.
+	err *error
 }
 
 func (tx *Tx) setErr(err error) error {
-	tx.err = err
+	*tx.err = err
 	return err
 }
 
 // Err returns the first error recorded by the transaction.
 func (tx *Tx) Err() error {
-	return tx.err
+	if tx.err == nil {
+		return nil
+	}
+	return *tx.err
+}
+
+// Commit commits all writes done in the transaction and releases its table
+// locks.
+//
+// Writes across all tables of the transaction are committed atomically: after
+// a crash, either all of them or none of them are visible when the DB is
+// reopened.
+//
+// If the transaction recorded an error through its fluent API (or while
+// iterating over a table), it is rolled back instead and that error is
+// returned.
+func (tx *Tx) Commit() error {
+	if err := tx.Err(); err != nil && !tx.done {
+		if err := tx.cfg.db.endTx(tx, false); err != nil {
+			return err
+		}
+		return err
+	}
+	return tx.cfg.db.endTx(tx, true)
+}
+
+// Rollback discards all writes done in the transaction and releases its table
+// locks.
+func (tx *Tx) Rollback() error {
+	return tx.cfg.db.endTx(tx, false)
 }
 
 // notInlinableNop is a simple test function.
@@ -170,7 +425,7 @@ func (tx *Tx) MustTable(key TableKey) TxTable {
 //
 // This is part of Tx's fluent API.
 func (tx *Tx) Exists(table TableKey, key Key) bool {
-	if tx.done || tx.err != nil {
+	if tx.done || tx.Err() != nil {
 		return false
 	}
 	tc, ok := tx.cfg.tables[table]
@@ -187,7 +442,7 @@ func (tx *Tx) Exists(table TableKey, key Key) bool {
 //
 // This is part of Tx's fluent API.
 func (tx *Tx) Read(table TableKey, key Key, value *[]byte) *Tx {
-	if tx.done || tx.err != nil {
+	if tx.done || tx.Err() != nil {
 		return tx
 	}
 	tc, ok := tx.cfg.tables[table]
@@ -216,7 +471,7 @@ func (tx *Tx) Read(table TableKey, key Key, value *[]byte) *Tx {
 //
 // This is part of Tx's fluent API.
 func (tx *Tx) Get(table TableKey, key Key) []byte {
-	if tx.done || tx.err != nil {
+	if tx.done || tx.Err() != nil {
 		return nil
 	}
 	tc, ok := tx.cfg.tables[table]
@@ -238,7 +493,7 @@ func (tx *Tx) Get(table TableKey, key Key) []byte {
 //
 // This is part of Tx's fluent API.
 func (tx *Tx) Put(table TableKey, key Key, value []byte) *Tx {
-	if tx.done || tx.err != nil {
+	if tx.done || tx.Err() != nil {
 		return tx
 	}
 	tc, ok := tx.cfg.tables[table]
@@ -251,12 +506,35 @@ func (tx *Tx) Put(table TableKey, key Key, value []byte) *Tx {
 		tx.setErr(ErrTableNotWritableInTx(table))
 		return tx
 	}
-
-	err := tc.table.put(key, value)
-	if err != nil {
+	if err := tc.table.checkSeparatorCollision(key, value); err != nil {
 		tx.setErr(err)
+		return tx
+	}
+
+	tc.table.stagePut(key, value)
+	return tx
+}
+
+// Delete the given key from the table. Deleting a key that does not exist is a
+// no-op.
+//
+// This is part of Tx's fluent API.
+func (tx *Tx) Delete(table TableKey, key Key) *Tx {
+	if tx.done || tx.Err() != nil {
+		return tx
+	}
+	tc, ok := tx.cfg.tables[table]
+	if !ok {
+		tx.setErr(ErrTableNotInTx(table))
+		return tx
 	}
 
+	if !tc.writable {
+		tx.setErr(ErrTableNotWritableInTx(table))
+		return tx
+	}
+
+	tc.table.stageDelete(key)
 	return tx
 }
 
@@ -266,6 +544,9 @@ func (tx *Tx) Put(table TableKey, key Key, value []byte) *Tx {
 // concurrent access by multiple goroutines.
 func (db *DB) PrepareTx(opts ...TxOption) (*TxConfig, error) {
 	prepCfg := definePrepTxCfg(opts...)
+	if db.readOnly && len(prepCfg.writeTables) > 0 {
+		return nil, ErrReadOnly
+	}
 	nbTables := len(prepCfg.readTables) + len(prepCfg.writeTables)
 	cfg := TxConfig{
 		db:        db,
@@ -1,7 +1,16 @@
 package simplewaldb
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"matheusd.com/depvendoredtestify/require"
 )
@@ -59,7 +68,9 @@ func TestTxFluentAPI(t *testing.T) {
 	clear(readVal)
 	readVal = readVal[:cap(readVal)]
 
-	runTestTx(t, txc, func(tx Tx) error {
+	// Transactions that recorded an error are rolled back, even if the
+	// function ignores it.
+	err := txc.RunTx(func(tx Tx) error {
 		// Errored trying to write a read-only table.
 		err := tx.
 			Put(readTable, key99, val99).
@@ -75,8 +86,9 @@ func TestTxFluentAPI(t *testing.T) {
 
 		return nil
 	})
+	require.ErrorIs(t, err, ErrTableNotWritableInTx(readTable))
 
-	runTestTx(t, txc, func(tx Tx) error {
+	err = txc.RunTx(func(tx Tx) error {
 		// Same as prior test, but Switched order of errors to test the
 		// first one is the one that is reported.
 		err := tx.
@@ -88,10 +100,11 @@ func TestTxFluentAPI(t *testing.T) {
 		require.Equal(t, emptyReadVal, readVal) // readVal not modified
 		return nil
 	})
+	require.ErrorIs(t, err, ErrTableNotInTx("does-not-exist"))
 
 	// Ensure key99 is still not written (because Put() happens after
 	// the error).
-	runTestTx(t, txc, func(tx Tx) error {
+	err = txc.RunTx(func(tx Tx) error {
 		err := tx.
 			Read(readTable, key99, &readVal).
 			Err()
@@ -99,7 +112,8 @@ func TestTxFluentAPI(t *testing.T) {
 		require.Equal(t, emptyReadVal, readVal) // readVal not modified
 		return nil
 	})
-	runTestTx(t, txc, func(tx Tx) error {
+	require.ErrorIs(t, err, ErrKeyNotFound(key99))
+	err = txc.RunTx(func(tx Tx) error {
 		err := tx.
 			Read(writeTable, key99, &readVal).
 			Err()
@@ -107,6 +121,7 @@ func TestTxFluentAPI(t *testing.T) {
 		require.Equal(t, emptyReadVal, readVal) // readVal not modified
 		return nil
 	})
+	require.ErrorIs(t, err, ErrKeyNotFound(key99))
 
 	// Put() after a Get() should work as expected.
 	runTestTx(t, txc, func(tx Tx) error {
@@ -116,13 +131,14 @@ func TestTxFluentAPI(t *testing.T) {
 	})
 
 	// But not if the key does not exist.
-	runTestTx(t, txc, func(tx Tx) error {
+	err = txc.RunTx(func(tx Tx) error {
 		err := tx.
 			Put(writeTable, key99, tx.Get(readTable, key99)).
 			Err()
 		require.ErrorIs(t, err, ErrKeyNotFound(key99))
 		return nil
 	})
+	require.ErrorIs(t, err, ErrKeyNotFound(key99))
 
 	// Values should be the expected ones.
 	runTestTx(t, txc, func(tx Tx) error {
@@ -136,6 +152,456 @@ func TestTxFluentAPI(t *testing.T) {
 	})
 }
 
+// TestTxCommitRollback tests that writes are only visible outside a
+// transaction after it is committed.
+func TestTxCommitRollback(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	key1, val1 := Key{0: 1}, []byte("value 1")
+	key2, val2 := Key{0: 2}, []byte("value 2")
+
+	// Writes are visible within the tx (read-your-writes).
+	tx, err := db.BeginTx(txc)
+	require.NoError(t, err)
+	require.False(t, tx.Exists(tableName, key1))
+	tx.Put(tableName, key1, val1)
+	require.True(t, tx.Exists(tableName, key1))
+	require.Equal(t, val1, tx.Get(tableName, key1))
+	readVal := make([]byte, 100)
+	require.NoError(t, tx.Read(tableName, key1, &readVal).Err())
+	require.Equal(t, val1, readVal)
+	tab := tx.MustTable(tableName)
+	count, err := tab.Count()
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+
+	// Rollback discards them.
+	require.NoError(t, tx.Rollback())
+	require.Error(t, tx.Rollback())
+	runTestTx(t, txc, func(tx Tx) error {
+		require.False(t, tx.Exists(tableName, key1))
+		return tx.Err()
+	})
+
+	// RunTx rolls back when f errors.
+	errTest := errors.New("test error")
+	err = txc.RunTx(func(tx Tx) error {
+		tx.Put(tableName, key1, val1)
+		return errTest
+	})
+	require.ErrorIs(t, err, errTest)
+
+	// RunTx rolls back when f panics.
+	require.Panics(t, func() {
+		txc.RunTx(func(tx Tx) error {
+			tx.Put(tableName, key1, val1)
+			panic("boom")
+		})
+	})
+
+	// Commit refuses to commit a tx that recorded an error.
+	tx, err = db.BeginTx(txc)
+	require.NoError(t, err)
+	err = tx.
+		Put(tableName, key1, val1).
+		Read("does-not-exist", key1, &readVal).
+		Commit()
+	require.ErrorIs(t, err, ErrTableNotInTx("does-not-exist"))
+
+	// Nothing was written so far.
+	runTestTx(t, txc, func(tx Tx) error {
+		require.False(t, tx.Exists(tableName, key1))
+		return tx.Err()
+	})
+
+	// Committed writes are visible to later txs.
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, key1, val1).Put(tableName, key2, val2).Err()
+	})
+	runTestTx(t, txc, func(tx Tx) error {
+		require.Equal(t, val1, tx.Get(tableName, key1))
+		require.Equal(t, val2, tx.Get(tableName, key2))
+		return tx.Err()
+	})
+}
+
+// TestTxDelete tests deleting keys from tables.
+func TestTxDelete(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+
+	key1, val1 := Key{0: 1}, []byte("value 1")
+	key2, val2 := Key{0: 2}, []byte("value 2")
+	key3, val3 := Key{0: 3}, []byte("value 3")
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.
+			Put(tableName, key1, val1).
+			Put(tableName, key2, val2).
+			Err()
+	})
+
+	// Delete within the same tx as a put and of a committed key.
+	runTestTx(t, txc, func(tx Tx) error {
+		tx.Put(tableName, key3, val3).
+			Delete(tableName, key3).
+			Delete(tableName, key1).
+			Delete(tableName, Key{0: 99})
+		require.False(t, tx.Exists(tableName, key1))
+		require.False(t, tx.Exists(tableName, key3))
+		tab := tx.MustTable(tableName)
+		count, err := tab.Count()
+		require.NoError(t, err)
+		require.Equal(t, 1, count)
+		return tx.Err()
+	})
+
+	checkDeleted := func(db *DB) {
+		t.Helper()
+		err := prepTestTx(t, db, WithReadTables(tableName)).RunTx(func(tx Tx) error {
+			require.False(t, tx.Exists(tableName, key1))
+			require.True(t, tx.Exists(tableName, key2))
+			require.False(t, tx.Exists(tableName, key3))
+			require.Nil(t, tx.Get(tableName, key1))
+			require.ErrorIs(t, tx.Err(), ErrKeyNotFound(key1))
+			tab := tx.MustTable(tableName)
+			count, err := tab.Count()
+			require.NoError(t, err)
+			require.Equal(t, 1, count)
+			return nil
+		})
+		require.ErrorIs(t, err, ErrKeyNotFound(key1))
+	}
+	checkDeleted(db)
+
+	// Deletion is kept after reopening.
+	require.NoError(t, db.Close())
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	checkDeleted(db)
+
+	// History is traceable across the tombstone.
+	var deleted []bool
+	err = db.tables[tableName].rangeRevEntries(key1, func(ir indexRecord) error {
+		deleted = append(deleted, ir.deleted)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false}, deleted)
+
+	// Key may be written again.
+	txc = prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, key1, val2).Err()
+	})
+	runTestTx(t, txc, func(tx Tx) error {
+		require.Equal(t, val2, tx.Get(tableName, key1))
+		return tx.Err()
+	})
+}
+
+// TestTxTableHistory tests iterating over the history of a key.
+func TestTxTableHistory(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	key, otherKey := Key{0: 1}, Key{0: 2}
+	values := [][]byte{[]byte("first"), []byte("second"), nil, []byte("fourth")}
+	for _, v := range values {
+		runTestTx(t, txc, func(tx Tx) error {
+			tx.Put(tableName, otherKey, []byte("other"))
+			if v == nil {
+				return tx.Delete(tableName, key).Err()
+			}
+			return tx.Put(tableName, key, v).Err()
+		})
+	}
+
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		var got []Version
+		for v, err := range tab.History(key) {
+			require.NoError(t, err)
+			got = append(got, v)
+		}
+		require.Len(t, got, len(values))
+		for i, v := range got {
+			want := values[len(values)-1-i]
+			require.Equal(t, want, v.Data)
+			require.Equal(t, want == nil, v.Deleted)
+			require.Equal(t, int64(len(want)), v.Size)
+			if i > 0 {
+				require.Less(t, v.IndexOffset, got[i-1].IndexOffset)
+				require.Less(t, v.Offset, got[i-1].Offset)
+			}
+		}
+
+		// Stopping early works.
+		var n int
+		for range tab.History(key) {
+			n++
+			break
+		}
+		require.Equal(t, 1, n)
+
+		// Keys without history do not yield anything.
+		for range tab.History(Key{0: 99}) {
+			t.Fatal("unexpected history")
+		}
+		return nil
+	})
+}
+
+// TestTxTableIteration tests iterating over the keys of a table in order.
+func TestTxTableIteration(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+
+	keys := []Key{
+		{0: 0x10, 1: 0x01},
+		{0: 0x10, 1: 0x02},
+		{0: 0x10, 1: 0xff, 15: 0x01},
+		{0: 0x11},
+		{0: 0x20},
+		{0: 0xff, 1: 0xff},
+	}
+	deletedKey := Key{0: 0x10, 1: 0x03}
+
+	// Write in random order. Half of the keys are only written in the
+	// same tx as the iteration.
+	perm := []int{4, 1, 5, 0, 3, 2}
+	runTestTx(t, txc, func(tx Tx) error {
+		tx.Put(tableName, deletedKey, []byte{0xaa})
+		for _, i := range perm[:3] {
+			tx.Put(tableName, keys[i], []byte{byte(i)})
+		}
+		return tx.Err()
+	})
+
+	collect := func(seq func(func(Key, []byte) bool)) []Key {
+		var res []Key
+		for k, v := range seq {
+			i := slices.Index(keys, k)
+			require.Equal(t, []byte{byte(i)}, v)
+			res = append(res, k)
+		}
+		return res
+	}
+
+	runTestTx(t, txc, func(tx Tx) error {
+		for _, i := range perm[3:] {
+			tx.Put(tableName, keys[i], []byte{byte(i)})
+		}
+		tx.Delete(tableName, deletedKey)
+		tab := tx.MustTable(tableName)
+
+		require.Equal(t, keys, slices.Collect(tab.Keys()))
+		require.Equal(t, keys, collect(tab.All()))
+		require.Equal(t, keys[1:4], collect(tab.Range(keys[1], keys[4])))
+		require.Equal(t, keys[3:], collect(tab.Range(keys[3], Key{})))
+		require.Equal(t, keys[:3], collect(tab.Prefix([]byte{0x10})))
+		require.Equal(t, keys[2:3], collect(tab.Prefix([]byte{0x10, 0xff})))
+		require.Equal(t, keys[5:], collect(tab.Prefix([]byte{0xff, 0xff})))
+		require.Empty(t, collect(tab.Prefix([]byte{0x30})))
+		require.Equal(t, keys, collect(tab.Prefix(nil)))
+		require.Empty(t, collect(tab.Prefix(make([]byte, KeySize+1))))
+		require.Equal(t, keys[:3], slices.Collect(tab.PrefixKeys([]byte{0x10})))
+		require.Equal(t, keys[5:], slices.Collect(tab.PrefixKeys([]byte{0xff, 0xff})))
+
+		// Stopping early.
+		var n int
+		for range tab.All() {
+			n++
+			if n == 2 {
+				break
+			}
+		}
+		require.Equal(t, 2, n)
+		return tx.Err()
+	})
+
+	// Same results after committing.
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		require.Equal(t, keys, slices.Collect(tab.Keys()))
+		got := maps.Collect(tab.All())
+		require.Len(t, got, len(keys))
+		return tx.Err()
+	})
+}
+
+// TestSeparatorCollisionCheck tests that values that contain the separator are
+// rejected when separator collision checks are enabled.
+func TestSeparatorCollisionCheck(t *testing.T) {
+	tableName := TableKey("test")
+	sepHex := strings.Repeat("5a", 31)
+	opts := []Option{WithTables(tableName), WithSeparatorHex(sepHex)}
+	sep := []byte("\n" + sepHex + "\n") // As written to data files.
+	cat := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+
+	tests := []struct {
+		name    string
+		value   []byte
+		collide bool
+	}{
+		{name: "no separator", value: []byte("value")},
+		{name: "empty", value: nil},
+		{name: "separator", value: sep, collide: true},
+		{name: "separator inside", value: cat([]byte("a"), sep, []byte("b")), collide: true},
+		{name: "separator at start", value: cat(sep, []byte("b")), collide: true},
+		{name: "partial separator", value: cat([]byte("a"), sep[:40], []byte("b"))},
+		{name: "partial separator at end", value: cat([]byte("a"), sep[:40])},
+
+		// The separator written after the value completes the one at
+		// the end of the value.
+		{name: "separator across end", value: cat([]byte("a"), sep[:len(sep)-1]), collide: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := newTestDB(t, append(opts, WithSeparatorCollisionCheck())...)
+			txc := prepTestTx(t, db, WithWriteTables(tableName))
+			err := txc.RunTx(func(tx Tx) error {
+				tab := tx.MustTable(tableName)
+				return tab.Put(Key{}, tc.value)
+			})
+			fluentErr := txc.RunTx(func(tx Tx) error {
+				return tx.Put(tableName, Key{1}, tc.value).Err()
+			})
+			if tc.collide {
+				require.ErrorIs(t, err, ErrSeparatorCollision{})
+				require.ErrorIs(t, fluentErr, ErrSeparatorCollision{})
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, fluentErr)
+			}
+		})
+	}
+
+	// Values are not checked without the option.
+	db := newTestDB(t, opts...)
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, Key{}, sep).Err()
+	})
+}
+
+// TestBeginTxContext tests that beginning transactions gives up waiting for the
+// locks of their tables when the context is done, releasing the locks acquired
+// so far.
+func TestBeginTxContext(t *testing.T) {
+	tableNames := []TableKey{"test1", "test2"}
+	db := newTestDB(t, WithTables(tableNames...))
+	txcBoth := prepTestTx(t, db, WithWriteTables(tableNames...))
+	txc1 := prepTestTx(t, db, WithWriteTables("test1"))
+	txc2 := prepTestTx(t, db, WithReadTables("test2"))
+
+	// A context that is already done fails even if the locks are free.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := db.BeginTxContext(ctx, txc1)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Hold the lock of the second table (for reading).
+	tx2, err := db.BeginTx(txc2)
+	require.NoError(t, err)
+
+	// The first table is locked before giving up on the second one.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = db.BeginTxContext(ctx, txcBoth)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	err = txcBoth.RunTxContext(ctx, func(tx Tx) error {
+		t.Fatal("transaction should not run")
+		return nil
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The lock of the first table was released.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = txc1.RunTxContext(ctx, func(tx Tx) error {
+		return tx.Put("test1", Key{}, []byte("value")).Err()
+	})
+	require.NoError(t, err)
+
+	// Readers are not blocked by the writers that gave up.
+	tx2b, err := db.BeginTxContext(ctx, txc2)
+	require.NoError(t, err)
+	require.NoError(t, tx2b.Rollback())
+
+	// Once the second table is unlocked, transactions that use both tables
+	// can begin.
+	require.NoError(t, tx2.Rollback())
+	err = txcBoth.RunTxContext(ctx, func(tx Tx) error {
+		return tx.Put("test2", Key{}, []byte("value")).Err()
+	})
+	require.NoError(t, err)
+}
+
+// TestBeginTxContextWriterPriority tests that a writer waiting for the lock of
+// a table with BeginTxContext is not starved by readers that continuously
+// overlap.
+func TestBeginTxContextWriterPriority(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	txcRead := prepTestTx(t, db, WithReadTables(tableName))
+	txcWrite := prepTestTx(t, db, WithWriteTables(tableName))
+
+	// Start readers that keep the table locked for reading, with their
+	// transactions overlapping.
+	const NBREADERS = 4
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	started := make(chan struct{}, NBREADERS)
+	for range NBREADERS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for first := true; ; first = false {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := txcRead.RunTx(func(tx Tx) error {
+					if first {
+						started <- struct{}{}
+					}
+					time.Sleep(time.Millisecond)
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	for range NBREADERS {
+		<-started
+	}
+
+	// The writer acquires the lock while the readers keep going.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := txcWrite.RunTxContext(ctx, func(tx Tx) error {
+		return tx.Put(tableName, Key{}, []byte("value")).Err()
+	})
+	require.NoError(t, err)
+}
+
 // BenchmarkTxCfgRunTx benchmarks the overhead of calling RunTx.
 func BenchmarkTxCfgRunTx(b *testing.B) {
 	tableName := TableKey("test")
@@ -179,3 +645,47 @@ func BenchmarkTxBeginEnd(b *testing.B) {
 		require.NoError(b, err)
 	}
 }
+
+// TestRunTxRecordedError tests that RunTx rolls back transactions that recorded
+// an error, even if the function ignores it.
+func TestRunTxRecordedError(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName), WithSeparatorCollisionCheck())
+	txc := prepTestTx(t, db, WithWriteTables(tableName))
+	key1, key2, key3 := Key{0: 1}, Key{0: 2}, Key{0: 3}
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tableName, key3, []byte("value")).Err()
+	})
+
+	// The error of the fluent API is recorded in the copy of the tx
+	// passed to the function.
+	sep := db.cfg.separator[:]
+	err := txc.RunTx(func(tx Tx) error {
+		tx.Put(tableName, key1, []byte("value")).Put(tableName, key2, sep)
+		return nil
+	})
+	require.ErrorIs(t, err, ErrSeparatorCollision{})
+
+	// Errors reading values while iterating are recorded too.
+	f, err := os.OpenFile(dataFilePath(db.cfg.rootDir, tableName, 0), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("X"), fileHeaderSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	err = txc.RunTx(func(tx Tx) error {
+		tx.Put(tableName, key1, []byte("value"))
+		tab := tx.MustTable(tableName)
+		for range tab.All() {
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, ErrChecksumMismatch{})
+
+	// Nothing was committed.
+	err = prepTestTx(t, db, WithReadTables(tableName)).RunTx(func(tx Tx) error {
+		require.False(t, tx.Exists(tableName, key1))
+		require.False(t, tx.Exists(tableName, key2))
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,210 @@
+package simplewaldb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// upgradeIndex rewrites the index of a table, which is in the given (older)
+// format, in the current format. The old index is moved into the archive dir.
+func upgradeIndex(rootDir string, tableKey TableKey, indexFile *os.File, format indexFormat) error {
+	dataFileNums, err := listDataFiles(rootDir, tableKey)
+	if err != nil {
+		return err
+	}
+	dataFiles := make(map[uint32]*os.File, len(dataFileNums))
+	dataStarts := make(map[uint32]int64, len(dataFileNums))
+	defer func() {
+		for _, f := range dataFiles {
+			f.Close()
+		}
+	}()
+	for _, n := range dataFileNums {
+		// Data files without a header may need their separators
+		// converted.
+		f, err := os.OpenFile(dataFilePath(rootDir, tableKey, n), os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		dataFiles[n] = f
+		if dataStarts[n], err = readDataFileStart(f); err != nil {
+			return err
+		}
+	}
+
+	indexPath := filepath.Join(rootDir, string(tableKey)+".index")
+	newIndexPath := indexPath + ".upgrade"
+	newIndexFile, err := os.OpenFile(newIndexPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		newIndexFile.Close()
+		os.Remove(newIndexPath)
+		return err
+	}
+
+	// Rewrite every record, computing the checksum of its data. The chain
+	// of previous versions is rebuilt, because index offsets change (and
+	// records written before v0.4.0 do not have it). Binary separators
+	// (of records written before v0.4.0) are converted to hex.
+	if _, err := indexFile.Seek(format.start, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	indexReader := bufio.NewReader(indexFile)
+	indexWriter := bufio.NewWriter(newIndexFile)
+	if _, err := indexWriter.Write(encodeFileHeader(indexFileMagic, indexFormatVersion)); err != nil {
+		return fail(err)
+	}
+	irw := newIndexRecordWriter(indexRecordSize)
+	irBuf := make([]byte, format.recordSize)
+	lastIndexOffset := make(map[Key]int64)
+	var data []byte
+	sepBuf := make([]byte, recordSeparatorSize)
+	converted := make(map[uint32]bool)
+	for indexOffset := int64(fileHeaderSize); ; indexOffset += indexRecordSize {
+		// A partial line at the end was never committed.
+		_, err := io.ReadFull(indexReader, irBuf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		var ir indexRecord
+		if err := ir.decode(irBuf); err != nil {
+			return fail(fmt.Errorf("error reading index entry: %v", err))
+		}
+		ir.prevIndexOffset = math.MaxInt64
+		if prev, ok := lastIndexOffset[ir.key]; ok {
+			ir.prevIndexOffset = prev
+		}
+		lastIndexOffset[ir.key] = indexOffset
+
+		f := dataFiles[ir.dataFile]
+		if f == nil {
+			return fail(fmt.Errorf("data file %d does not exist", ir.dataFile))
+		}
+		data = slices.Grow(data[:0], int(ir.size))[:ir.size]
+		if _, err := f.ReadAt(data, ir.offset); err != nil {
+			return fail(fmt.Errorf("error reading data of key %x: %v", ir.key, err))
+		}
+		ir.checksum, ir.hasChecksum = crc32.Checksum(data, crc32cTable), true
+
+		if dataStarts[ir.dataFile] == 0 {
+			if _, err := f.ReadAt(sepBuf, ir.offset+ir.size); err != nil {
+				return fail(fmt.Errorf("error reading separator of key %x: %v", ir.key, err))
+			}
+			if sep, ok := separatorFromV1(sepBuf); ok {
+				if _, err := f.WriteAt(sep[:], ir.offset+ir.size); err != nil {
+					return fail(err)
+				}
+				converted[ir.dataFile] = true
+			}
+		}
+
+		if _, err := indexWriter.Write(irw.writeEntry(&ir)); err != nil {
+			return fail(err)
+		}
+	}
+	if err := indexWriter.Flush(); err != nil {
+		return fail(err)
+	}
+	for n := range converted {
+		if err := dataFiles[n].Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := newIndexFile.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := newIndexFile.Close(); err != nil {
+		return fail(err)
+	}
+
+	// Archive the old index and move the new one into place.
+	if err := removeCheckpoint(rootDir, tableKey); err != nil {
+		return fail(err)
+	}
+	archiveDir, err := newArchiveDir(rootDir, tableKey, "upgrade")
+	if err != nil {
+		return fail(err)
+	}
+	err = os.Rename(indexPath, filepath.Join(archiveDir, filepath.Base(indexPath)))
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(newIndexPath, indexPath); err != nil {
+		return err
+	}
+	return syncDir(rootDir)
+}
+
+// Upgrade rewrites the index files of all tables in the given root dir that
+// are in an older format in the current one. It returns the tables that were
+// upgraded.
+//
+// Index files written before v0.4.0 must be upgraded before their tables can
+// be opened. Other older index files are still used as-is (and are upgraded by
+// compacting their tables), but upgrading adds checksums to their records. The
+// old index files are moved into the archive dir.
+//
+// The binary separators of records in data files written before v0.4.0 are
+// replaced (in place) with hex-encoded ones, so that they can be verified (see
+// Verify) and used to rebuild indexes (see RebuildIndex). Data files are
+// otherwise never rewritten: their offsets do not change, and data files
+// without a header are still read as-is. Upgrading again after being
+// interrupted converts the remaining separators.
+//
+// This fails with ErrDBLocked if the DB is open.
+func Upgrade(rootDir string) ([]TableKey, error) {
+	dirLock, err := lockRootDir(rootDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer dirLock.unlock()
+
+	// Index offsets change when upgrading, so apply any committed
+	// transaction that is still in the WAL first.
+	w, err := openWAL(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.close(); err != nil {
+		return nil, err
+	}
+
+	tables, err := ListTables(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var upgraded []TableKey
+	for _, tableKey := range tables {
+		indexPath := filepath.Join(rootDir, string(tableKey)+".index")
+		indexFile, err := os.Open(indexPath)
+		if err != nil {
+			return upgraded, err
+		}
+		format, err := readIndexFormat(indexFile)
+		if err == nil && format.version != indexFormatVersion {
+			err = upgradeIndex(rootDir, tableKey, indexFile, format)
+			if err == nil {
+				upgraded = append(upgraded, tableKey)
+			}
+		}
+		indexFile.Close()
+		if err != nil {
+			return upgraded, fmt.Errorf("error upgrading table %q: %v", tableKey, err)
+		}
+	}
+	return upgraded, nil
+}
@@ -0,0 +1,210 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestUpgrade tests upgrading index files written in older formats.
+func TestUpgrade(t *testing.T) {
+	tableNames := []TableKey{"test1", "test2", "test3"}
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableNames...)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableNames...))
+
+	const NBKEYS = 10
+	value := func(k, v int) []byte { return bytes.Repeat([]byte{byte(k), byte(v)}, k+1) }
+	for v := range 2 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range NBKEYS {
+				for _, tableName := range tableNames {
+					tx.Put(tableName, keyFromInt(k), value(k, v))
+				}
+			}
+			return tx.Err()
+		})
+	}
+	runTestTx(t, txc, func(tx Tx) error {
+		for _, tableName := range tableNames {
+			tx.Delete(tableName, keyFromInt(1))
+		}
+		return tx.Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Rewrite the indexes of the first table as written before v0.4.0 and
+	// of the second one as written by v0.4.0. Those formats are the same as
+	// the current one, without the trailing fields and the header.
+	indexPath := func(tableName TableKey) string {
+		return filepath.Join(rootDir, string(tableName)+".index")
+	}
+	wantIndex, err := os.ReadFile(indexPath(tableNames[0]))
+	require.NoError(t, err)
+	rewriteIndex := func(tableName TableKey, recordSize int) {
+		indexData, err := os.ReadFile(indexPath(tableName))
+		require.NoError(t, err)
+		var oldIndex []byte
+		for i := fileHeaderSize; i < len(indexData); i += indexRecordSize {
+			oldIndex = append(oldIndex, indexData[i:i+recordSize-1]...)
+			oldIndex = append(oldIndex, lfChar)
+		}
+		require.NoError(t, os.WriteFile(indexPath(tableName), oldIndex, 0o600))
+	}
+	rewriteIndex(tableNames[0], indexRecordSizeV1)
+	rewriteIndex(tableNames[1], indexRecordSizeV2)
+
+	// Tables with indexes written before v0.4.0 cannot be opened.
+	_, err = NewDB(opts...)
+	require.ErrorIs(t, err, ErrUpgradeRequired{})
+
+	// Upgrading results in the same index files as written by the current
+	// version.
+	upgraded, err := Upgrade(rootDir)
+	require.NoError(t, err)
+	require.Equal(t, tableNames[:2], upgraded)
+	for _, tableName := range tableNames {
+		gotIndex, err := os.ReadFile(indexPath(tableName))
+		require.NoError(t, err)
+		require.Equal(t, wantIndex, gotIndex)
+	}
+	entries, err := os.ReadDir(filepath.Join(rootDir, archiveDirName))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	// Upgrading again does nothing.
+	upgraded, err = Upgrade(rootDir)
+	require.NoError(t, err)
+	require.Empty(t, upgraded)
+
+	// The DB works with the upgraded indexes.
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	defer db.Close()
+	txc = prepTestTx(t, db, WithReadTables(tableNames...))
+	runTestTx(t, txc, func(tx Tx) error {
+		for _, tableName := range tableNames {
+			tab := tx.MustTable(tableName)
+			count, err := tab.Count()
+			require.NoError(t, err)
+			require.Equal(t, NBKEYS-1, count)
+			var versions [][]byte
+			for v, err := range tab.History(keyFromInt(2)) {
+				require.NoError(t, err)
+				versions = append(versions, v.Data)
+			}
+			require.Equal(t, [][]byte{value(2, 1), value(2, 0)}, versions)
+		}
+		return nil
+	})
+}
+
+// TestFileHeaders tests the headers of index and data files.
+func TestFileHeaders(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tableName)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	dataPath := dataFilePath(rootDir, tableName, 0)
+	indexData, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, "swdbindx 00000003\n", string(indexData))
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	require.Equal(t, "swdbdata 00000002\n", string(data))
+
+	// Files in formats of newer versions are not opened.
+	for _, path := range []string{indexPath, dataPath} {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		newer := append(encodeFileHeader([8]byte(b), 0xff), b[fileHeaderSize:]...)
+		require.NoError(t, os.WriteFile(path, newer, 0o600))
+		_, err = NewDB(opts...)
+		require.ErrorIs(t, err, ErrUnsupportedFormat{})
+		require.NoError(t, os.WriteFile(path, b, 0o600))
+	}
+	db, err = NewDB(opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+// TestUpgradeV1Data tests upgrading a table written before v0.4.0, whose data
+// file has no header and binary record separators.
+func TestUpgradeV1Data(t *testing.T) {
+	tableName := TableKey("test")
+	rootDir := t.TempDir()
+	sepHex := strings.Repeat("5a", 31)
+	opts := []Option{WithRootDir(rootDir), WithSeparatorHex(sepHex), WithTables(tableName)}
+
+	// Write the data and index files as written before v0.4.0: the
+	// separator is a line feed, the 31 bytes of the separator, 31 zero
+	// bytes and a line feed.
+	binSep := "\n" + strings.Repeat("\x5a", 31) + strings.Repeat("\x00", 31) + "\n"
+	hexSep := "\n" + sepHex + "\n"
+	key1, key2 := keyFromInt(1), keyFromInt(2)
+	records := []struct {
+		key   Key
+		value string
+	}{{key1, "one"}, {key2, "two"}, {key1, "uno"}}
+	var data, index, wantData string
+	for _, rec := range records {
+		index += fmt.Sprintf("%08x %016x %016x %x\n", 0, len(data), len(rec.value), rec.key)
+		trailer := fmt.Sprintf("%x", rec.key) + strings.Repeat("\n", recordPaddingSize)
+		data += rec.value + binSep + trailer
+		wantData += rec.value + hexSep + trailer
+	}
+	require.Len(t, index, len(records)*indexRecordSizeV1)
+	dataPath := dataFilePath(rootDir, tableName, 0)
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	require.NoError(t, os.WriteFile(dataPath, []byte(data), 0o600))
+	require.NoError(t, os.WriteFile(indexPath, []byte(index), 0o600))
+
+	// The separators are converted in place.
+	upgraded, err := Upgrade(rootDir)
+	require.NoError(t, err)
+	require.Equal(t, []TableKey{tableName}, upgraded)
+	gotData, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	require.Equal(t, wantData, string(gotData))
+
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithReadTables(tableName))
+	runTestTx(t, txc, func(tx Tx) error {
+		tab := tx.MustTable(tableName)
+		var versions []string
+		for v, err := range tab.History(key1) {
+			require.NoError(t, err)
+			versions = append(versions, string(v.Data))
+		}
+		require.Equal(t, []string{"uno", "one"}, versions)
+		require.Equal(t, []byte("two"), tx.Get(tableName, key2))
+		return tx.Err()
+	})
+	require.NoError(t, db.Close())
+
+	// The table can be verified, and its index rebuilt from the data file.
+	report, err := Verify(rootDir, opts...)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Issues)
+	require.Equal(t, len(records), report.Records[tableName])
+	wantIndex, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	n, err := RebuildIndex(rootDir, tableName, sepHex)
+	require.NoError(t, err)
+	require.Equal(t, len(records), n)
+	gotIndex, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, wantIndex, gotIndex)
+}
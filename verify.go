@@ -0,0 +1,352 @@
+package simplewaldb
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// VerifyIssueKind is the kind of an issue found when verifying a table.
+type VerifyIssueKind string
+
+const (
+	// IssueTornIndex is a partial line at the end of the index.
+	IssueTornIndex VerifyIssueKind = "torn index"
+
+	// IssueBadIndexRecord is an index line that cannot be decoded.
+	IssueBadIndexRecord VerifyIssueKind = "bad index record"
+
+	// IssueBadPrevIndexOffset is an index record whose previous index
+	// offset does not point to the previous version of its key.
+	IssueBadPrevIndexOffset VerifyIssueKind = "bad previous index offset"
+
+	// IssueMissingData is an index record that points past the end of its
+	// data file (or to a data file that does not exist).
+	IssueMissingData VerifyIssueKind = "missing data"
+
+	// IssueBadTrailer is an index record that is not followed in the data
+	// file by the separator, its key and the padding that matches whether
+	// it is a tombstone.
+	IssueBadTrailer VerifyIssueKind = "bad record trailer"
+
+	// IssueOverlap is a record that overlaps a previous one in the data
+	// file.
+	IssueOverlap VerifyIssueKind = "overlap"
+
+	// IssueGap is a range of a data file, between two records, that is not
+	// referenced by any index record.
+	IssueGap VerifyIssueKind = "gap"
+
+	// IssueOrphanedData is a range at the end of a data file that is not
+	// referenced by any index record.
+	IssueOrphanedData VerifyIssueKind = "orphaned data"
+
+	// IssueChecksumMismatch is a record whose data does not match the
+	// checksum in its index record.
+	IssueChecksumMismatch VerifyIssueKind = "checksum mismatch"
+)
+
+// VerifyIssue is an issue found when verifying a table.
+type VerifyIssue struct {
+	Table TableKey
+	Kind  VerifyIssueKind
+
+	// IndexOffset is the offset of the index record with the issue, or -1
+	// when the issue is not related to a specific index record.
+	IndexOffset int64
+
+	// DataFile, DataOffset and Size are the range of the data file related
+	// to the issue (if any).
+	DataFile   uint32
+	DataOffset int64
+	Size       int64
+
+	Detail string
+}
+
+// String returns a human-readable description of the issue.
+func (vi VerifyIssue) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table %q: %s", vi.Table, vi.Kind)
+	if vi.IndexOffset >= 0 {
+		fmt.Fprintf(&b, " at index offset %d", vi.IndexOffset)
+	}
+	if vi.Size > 0 {
+		fmt.Fprintf(&b, " (data file %d, offset %d, size %d)", vi.DataFile,
+			vi.DataOffset, vi.Size)
+	}
+	if vi.Detail != "" {
+		fmt.Fprintf(&b, ": %s", vi.Detail)
+	}
+	return b.String()
+}
+
+// VerifyReport is the result of verifying the tables of a DB.
+type VerifyReport struct {
+	// Records is the number of index records of each verified table.
+	Records map[TableKey]int
+
+	Issues []VerifyIssue
+}
+
+// OK returns true if no issues were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// verifyTable verifies the index and data files of a table, adding the issues
+// found to the report. The separators are the current one followed by any
+// previous ones (see WithPreviousSeparatorsHex).
+func verifyTable(rootDir string, tableKey TableKey, manifest *dbManifest, seps []recordSeparator, report *VerifyReport) error {
+	addIssue := func(vi VerifyIssue) {
+		vi.Table = tableKey
+		report.Issues = append(report.Issues, vi)
+	}
+
+	indexFile, err := os.Open(filepath.Join(rootDir, string(tableKey)+".index"))
+	if err != nil {
+		return err
+	}
+	defer indexFile.Close()
+
+	dataFileNums, err := listDataFiles(rootDir, tableKey)
+	if err != nil {
+		return err
+	}
+	dataFileSeps, err := manifest.dataFileSeparators(tableKey, dataFileNums, seps)
+	if err != nil {
+		return err
+	}
+	dataFiles := make(map[uint32]*os.File, len(dataFileNums))
+	dataStarts := make(map[uint32]int64, len(dataFileNums))
+	dataSizes := make(map[uint32]int64, len(dataFileNums))
+	defer func() {
+		for _, f := range dataFiles {
+			f.Close()
+		}
+	}()
+	for _, n := range dataFileNums {
+		f, err := os.Open(dataFilePath(rootDir, tableKey, n))
+		if err != nil {
+			return err
+		}
+		dataFiles[n] = f
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		dataSizes[n] = stat.Size()
+		if dataStarts[n], err = readDataFileStart(f); err != nil {
+			return err
+		}
+	}
+
+	format, err := readIndexFormat(indexFile)
+	if err == nil && format.version == indexFormatV1 {
+		err = ErrUpgradeRequired{File: indexFile.Name()}
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := indexFile.Seek(format.start, io.SeekStart); err != nil {
+		return err
+	}
+
+	// Check every index record, the trailer of its data and its checksum
+	// (if the index has them).
+	indexReader := bufio.NewReader(indexFile)
+	irBuf := make([]byte, format.recordSize)
+	trailer := make([]byte, recordTrailerSize)
+	var data []byte
+	lastVersion := make(map[Key]int64)
+
+	// zeroed are the issues of records whose data is zeroed instead of
+	// matching their checksum, keyed by the record's key. They are only
+	// reported if the record is the current value of its key, because dead
+	// records may have been punched (see DB.PunchDeadRecords).
+	zeroed := make(map[Key]VerifyIssue)
+	records := make(map[uint32][]indexRecord, len(dataFileNums))
+	for indexOffset := format.start; ; indexOffset += format.recordSize {
+		n, err := io.ReadFull(indexReader, irBuf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			addIssue(VerifyIssue{Kind: IssueTornIndex, IndexOffset: indexOffset,
+				Detail: fmt.Sprintf("%d trailing bytes", n)})
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		ir := indexRecord{indexOffset: indexOffset}
+		if err := ir.decode(irBuf); err != nil {
+			addIssue(VerifyIssue{Kind: IssueBadIndexRecord, IndexOffset: indexOffset,
+				Detail: err.Error()})
+			continue
+		}
+		report.Records[tableKey]++
+
+		prev, hasPrev := lastVersion[ir.key]
+		switch {
+		case ir.prevIndexOffset == math.MaxInt64 && hasPrev:
+			addIssue(VerifyIssue{Kind: IssueBadPrevIndexOffset, IndexOffset: indexOffset,
+				Detail: fmt.Sprintf("key %x has a previous version at offset %d", ir.key, prev)})
+		case ir.prevIndexOffset == math.MaxInt64:
+		case ir.prevIndexOffset >= indexOffset:
+			addIssue(VerifyIssue{Kind: IssueBadPrevIndexOffset, IndexOffset: indexOffset,
+				Detail: fmt.Sprintf("points to later offset %d", ir.prevIndexOffset)})
+		case !hasPrev || prev != ir.prevIndexOffset:
+			addIssue(VerifyIssue{Kind: IssueBadPrevIndexOffset, IndexOffset: indexOffset,
+				Detail: fmt.Sprintf("offset %d is not the previous version of key %x",
+					ir.prevIndexOffset, ir.key)})
+		}
+		lastVersion[ir.key] = indexOffset
+		delete(zeroed, ir.key)
+
+		dataIssue := VerifyIssue{IndexOffset: indexOffset, DataFile: ir.dataFile,
+			DataOffset: ir.offset, Size: ir.size + recordTrailerSize}
+		f := dataFiles[ir.dataFile]
+		if f == nil {
+			dataIssue.Kind, dataIssue.Detail = IssueMissingData, "data file does not exist"
+			addIssue(dataIssue)
+			continue
+		}
+		if ir.offset+ir.size+recordTrailerSize > dataSizes[ir.dataFile] {
+			dataIssue.Kind = IssueMissingData
+			dataIssue.Detail = fmt.Sprintf("data file size is %d", dataSizes[ir.dataFile])
+			addIssue(dataIssue)
+			continue
+		}
+		records[ir.dataFile] = append(records[ir.dataFile], ir)
+
+		if _, err := f.ReadAt(trailer, ir.offset+ir.size); err != nil {
+			return err
+		}
+		key, deleted, ok := decodeRecordTrailer(trailer[recordSeparatorSize:])
+		dataIssue.Kind = IssueBadTrailer
+		switch {
+		case [recordSeparatorSize]byte(trailer) != dataFileSeps[ir.dataFile]:
+			dataIssue.Detail = "separator not found"
+			addIssue(dataIssue)
+		case !ok:
+			dataIssue.Detail = "invalid key or padding after separator"
+			addIssue(dataIssue)
+		case key != ir.key:
+			dataIssue.Detail = fmt.Sprintf("found key %x instead of %x", key, ir.key)
+			addIssue(dataIssue)
+		case deleted != ir.deleted:
+			dataIssue.Detail = fmt.Sprintf("tombstone mismatch (index %v, data %v)",
+				ir.deleted, deleted)
+			addIssue(dataIssue)
+		}
+
+		if !ir.hasChecksum {
+			continue
+		}
+		data = slices.Grow(data[:0], int(ir.size))[:ir.size]
+		if _, err := f.ReadAt(data, ir.offset); err != nil {
+			return err
+		}
+		if !checksumMatches(data, ir.checksum, true) {
+			dataIssue.Kind = IssueChecksumMismatch
+			dataIssue.Detail = fmt.Sprintf("data checksum is %08x instead of %08x",
+				crc32.Checksum(data, crc32cTable), ir.checksum)
+			addIssue(dataIssue)
+		} else if !checksumMatches(data, ir.checksum, false) {
+			dataIssue.Kind = IssueChecksumMismatch
+			dataIssue.Detail = fmt.Sprintf("data is zeroed (checksum %08x)", ir.checksum)
+			zeroed[ir.key] = dataIssue
+		}
+	}
+	for _, vi := range slices.SortedFunc(maps.Values(zeroed), func(a, b VerifyIssue) int {
+		return cmp.Compare(a.IndexOffset, b.IndexOffset)
+	}) {
+		addIssue(vi)
+	}
+
+	// Check that the records cover every data file exactly.
+	for _, n := range dataFileNums {
+		recs := records[n]
+		slices.SortFunc(recs, func(a, b indexRecord) int {
+			return cmp.Compare(a.offset, b.offset)
+		})
+		end := dataStarts[n]
+		for _, ir := range recs {
+			if ir.offset < end {
+				addIssue(VerifyIssue{Kind: IssueOverlap, IndexOffset: ir.indexOffset,
+					DataFile: n, DataOffset: ir.offset, Size: end - ir.offset})
+			} else if ir.offset > end {
+				addIssue(VerifyIssue{Kind: IssueGap, IndexOffset: -1,
+					DataFile: n, DataOffset: end, Size: ir.offset - end})
+			}
+			end = max(end, ir.offset+ir.size+recordTrailerSize)
+		}
+		if dataSizes[n] > end {
+			addIssue(VerifyIssue{Kind: IssueOrphanedData, IndexOffset: -1,
+				DataFile: n, DataOffset: end, Size: dataSizes[n] - end})
+		}
+	}
+	return nil
+}
+
+// Verify cross-checks the index and data files of the tables of the DB in the
+// given root dir. Only the tables (see WithTables) and separator (see
+// WithSeparatorHex and WithPreviousSeparatorsHex) options are used. When no
+// tables are specified, every table found in the root dir is verified.
+//
+// For every table, every index record is decoded and checked to point to data
+// that is followed by the separator and the record's key (and matches the
+// record's checksum, if it has one, or is zeroed for dead records, which may
+// have been punched), and to link to the previous version of its key. The data
+// files are checked to be fully covered by index records, without overlaps.
+//
+// The returned error is only set when the files cannot be read (or the
+// separator does not match the one in the manifest of the DB, with
+// ErrSeparatorMismatch, or a previous separator is needed but was not given,
+// with ErrMissingSeparator). Corruption is reported as issues in the report.
+// This fails with ErrDBLocked if the DB is open.
+func Verify(rootDir string, opts ...Option) (*VerifyReport, error) {
+	cfg := defineOptions(opts...)
+
+	dirLock, err := lockRootDir(rootDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dirLock.unlock()
+
+	manifest, err := loadManifest(rootDir, cfg.separator)
+	if err != nil {
+		return nil, err
+	}
+	seps := append([]recordSeparator{cfg.separator}, cfg.prevSeparators...)
+
+	tables := cfg.tables
+	if len(tables) == 0 {
+		tables, err = ListTables(rootDir)
+		if err != nil {
+			return nil, err
+		}
+		if len(tables) == 0 {
+			return nil, fmt.Errorf("no tables found in %q", rootDir)
+		}
+	}
+
+	report := &VerifyReport{Records: make(map[TableKey]int, len(tables))}
+	for _, tableKey := range tables {
+		if err := verifyTable(rootDir, tableKey, manifest, seps, report); err != nil {
+			return nil, fmt.Errorf("error verifying table %q: %w", tableKey, err)
+		}
+	}
+	return report, nil
+}
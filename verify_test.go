@@ -0,0 +1,101 @@
+package simplewaldb
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestVerify tests verifying the files of the tables of a DB.
+func TestVerify(t *testing.T) {
+	tableNames := []TableKey{"test1", "test2"}
+	rootDir := t.TempDir()
+	db, err := NewDB(WithRootDir(rootDir), WithTables(tableNames...))
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tableNames...))
+
+	const NBKEYS = 10
+	value := func(k int) []byte { return bytes.Repeat([]byte{byte(k)}, 10*k) }
+	for range 2 {
+		runTestTx(t, txc, func(tx Tx) error {
+			for k := range NBKEYS {
+				for _, tableName := range tableNames {
+					tx.Put(tableName, keyFromInt(k), value(k))
+				}
+			}
+			return tx.Err()
+		})
+	}
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Delete(tableNames[0], keyFromInt(1)).Err()
+	})
+	require.NoError(t, db.Close())
+
+	// Files of a cleanly closed DB have no issues.
+	report, err := Verify(rootDir)
+	require.NoError(t, err)
+	require.Empty(t, report.Issues)
+	require.True(t, report.OK())
+	require.Equal(t, map[TableKey]int{"test1": NBKEYS*2 + 1, "test2": NBKEYS * 2}, report.Records)
+
+	// Corrupt the files of the first table.
+	tableName := tableNames[0]
+	indexPath := filepath.Join(rootDir, string(tableName)+".index")
+	dataPath := dataFilePath(rootDir, tableName, 0)
+	indexData, err := os.ReadFile(indexPath)
+	require.NoError(t, err)
+	data, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	recordOffset := func(i int) int { return fileHeaderSize + i*indexRecordSize }
+	readRecord := func(i int) indexRecord {
+		var ir indexRecord
+		require.NoError(t, ir.decode(indexData[recordOffset(i):recordOffset(i+1)]))
+		ir.indexOffset = int64(recordOffset(i))
+		return ir
+	}
+	writeRecord := func(i int, ir indexRecord) {
+		copy(indexData[recordOffset(i):], newIndexRecordWriter(indexRecordSize).writeEntry(&ir))
+	}
+
+	// Break the version chain of the last record.
+	last := NBKEYS * 2
+	lastIR := readRecord(last)
+	lastIR.prevIndexOffset = math.MaxInt64
+	writeRecord(last, lastIR)
+
+	// Change the key after the separator of the 4th record.
+	ir3 := readRecord(3)
+	data[ir3.offset+ir3.size+recordSeparatorSize] = 'x'
+
+	// Make the 6th record overlap the previous one, leaving a gap after it.
+	ir5 := readRecord(5)
+	ir5.offset--
+	writeRecord(5, ir5)
+
+	require.NoError(t, os.WriteFile(indexPath, append(indexData, "0000"...), 0o600))
+	require.NoError(t, os.WriteFile(dataPath, append(data, "orphan"...), 0o600))
+
+	report, err = Verify(rootDir, WithTables(tableName))
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	kinds := make(map[VerifyIssueKind]int)
+	for _, issue := range report.Issues {
+		require.Equal(t, tableName, issue.Table)
+		require.NotEmpty(t, issue.String())
+		kinds[issue.Kind]++
+	}
+	wantKinds := map[VerifyIssueKind]int{
+		IssueTornIndex:          1,
+		IssueBadPrevIndexOffset: 1,
+		IssueBadTrailer:         2, // 4th record key and 6th record separator.
+		IssueOverlap:            1,
+		IssueChecksumMismatch:   1, // 6th record data.
+		IssueGap:                1,
+		IssueOrphanedData:       1,
+	}
+	require.Equal(t, wantKinds, kinds)
+}
@@ -0,0 +1,230 @@
+package simplewaldb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walFileName is the name of the write-ahead log file inside the root dir.
+const walFileName = "db.wal"
+
+// walMagic is the magic string at the start of every WAL record.
+var walMagic = [8]byte{'s', 'w', 'd', 'b', 'w', 'a', 'l', '1'}
+
+// errWALApply is wrapped in the sticky WAL error when a committed record could
+// not be applied.
+var errWALApply = errors.New("WAL record committed but not applied; reopen the DB to replay it")
+
+// walTableEntry is the set of index lines committed to a single table in a
+// WAL record.
+type walTableEntry struct {
+	table       TableKey
+	indexOffset int64
+	indexData   []byte
+}
+
+// wal is the write-ahead log of the database.
+//
+// Data for every record is appended to the data files of the tables as soon as
+// it is written, but the corresponding index lines (which are what makes a
+// record visible) are only written once all of them (across all tables of a
+// transaction) have been committed to the WAL. After the index lines are
+// written, the WAL is cleared.
+//
+// A WAL record is:
+// 8 bytes magic
+// 4 bytes number of tables
+// for each table:
+//
+//	2 bytes table name length
+//	N bytes table name
+//	8 bytes offset into the index file
+//	8 bytes length of index data
+//	N bytes index data
+//
+// 4 bytes CRC32 (Castagnoli) of all previous bytes
+//
+// All integers are big endian. A WAL record that is torn or fails its checksum
+// was never committed and is discarded.
+type wal struct {
+	mu  sync.Mutex
+	f   *os.File
+	buf []byte
+
+	// err is set when a committed record could not be fully applied to the
+	// index files (or the data of a failed commit could not be discarded).
+	// Further commits are refused until the DB is reopened (at which point
+	// the record is replayed and the data quarantined).
+	err error
+}
+
+// encode the WAL record for the given entries into w.buf.
+func (w *wal) encode(entries []walTableEntry) {
+	b := append(w.buf[:0], walMagic[:]...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(entries)))
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.table)))
+		b = append(b, e.table...)
+		b = binary.BigEndian.AppendUint64(b, uint64(e.indexOffset))
+		b = binary.BigEndian.AppendUint64(b, uint64(len(e.indexData)))
+		b = append(b, e.indexData...)
+	}
+	b = binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crc32cTable))
+	w.buf = b
+}
+
+// commit durably writes the entries as a single WAL record. After this
+// returns without an error, the entries are considered committed and will be
+// replayed if the process crashes before the WAL is cleared.
+//
+// The caller must hold w.mu.
+func (w *wal) commit(entries []walTableEntry) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	w.encode(entries)
+	if _, err := w.f.WriteAt(w.buf, 0); err != nil {
+		return fmt.Errorf("error writing WAL record: %v", err)
+	}
+
+	// A previous commit that failed may have left a longer record in the
+	// file, which would make this one fail its checksum.
+	if err := w.f.Truncate(int64(len(w.buf))); err != nil {
+		return fmt.Errorf("error truncating WAL: %v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("error fsyncing WAL: %v", err)
+	}
+	return nil
+}
+
+// clear the WAL after its last record has been applied.
+//
+// The caller must hold w.mu.
+func (w *wal) clear() error {
+	if err := w.f.Truncate(0); err != nil {
+		return fmt.Errorf("error truncating WAL: %v", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return fmt.Errorf("error fsyncing WAL: %v", err)
+	}
+	return nil
+}
+
+// stickyErr returns the error that refuses further commits (if any).
+func (w *wal) stickyErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// close the WAL file.
+func (w *wal) close() error {
+	return w.f.Close()
+}
+
+// decodeWALRecord decodes a WAL record. It returns nil entries (and no error)
+// if the record is empty, torn or otherwise invalid (i.e. it was never
+// committed).
+func decodeWALRecord(b []byte) []walTableEntry {
+	if len(b) < len(walMagic)+4+4 {
+		return nil
+	}
+	if [8]byte(b[:8]) != walMagic {
+		return nil
+	}
+	crc := binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(b[:len(b)-4], crc32cTable) != crc {
+		return nil
+	}
+
+	b = b[8 : len(b)-4]
+	nbTables := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	entries := make([]walTableEntry, 0, nbTables)
+	for range nbTables {
+		if len(b) < 2 {
+			return nil
+		}
+		nameLen := int(binary.BigEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < nameLen+16 {
+			return nil
+		}
+		e := walTableEntry{table: TableKey(b[:nameLen])}
+		b = b[nameLen:]
+		e.indexOffset = int64(binary.BigEndian.Uint64(b))
+		dataLen := binary.BigEndian.Uint64(b[8:])
+		b = b[16:]
+		if uint64(len(b)) < dataLen {
+			return nil
+		}
+		e.indexData, b = b[:dataLen], b[dataLen:]
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// replayWALEntries writes the index data of committed WAL entries into the
+// index files of the tables in rootDir.
+func replayWALEntries(rootDir string, entries []walTableEntry) error {
+	for _, e := range entries {
+		indexPath := filepath.Join(rootDir, string(e.table)+".index")
+		f, err := os.OpenFile(indexPath, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return fmt.Errorf("error opening index of table %q for WAL replay: %v",
+				e.table, err)
+		}
+		_, err = f.WriteAt(e.indexData, e.indexOffset)
+		if err == nil {
+			err = f.Sync()
+		}
+		closeErr := f.Close()
+		if err != nil {
+			return fmt.Errorf("error replaying WAL into table %q: %v", e.table, err)
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+	return nil
+}
+
+// openWAL opens the WAL in the given root dir, replaying any committed record
+// that was not yet fully applied to the index files.
+func openWAL(rootDir string) (*wal, error) {
+	walPath := filepath.Join(rootDir, walFileName)
+	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &wal{f: f}
+	record, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading WAL: %v", err)
+	}
+	if len(record) == 0 {
+		return w, nil
+	}
+
+	if entries := decodeWALRecord(record); entries != nil {
+		if err := replayWALEntries(rootDir, entries); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := w.clear(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
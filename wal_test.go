@@ -0,0 +1,162 @@
+package simplewaldb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"matheusd.com/depvendoredtestify/require"
+)
+
+// TestWALReplay tests that a committed WAL record that was not applied to the
+// index files is replayed when the DB is reopened, while a torn record is
+// discarded.
+func TestWALReplay(t *testing.T) {
+	tab1, tab2 := TableKey("tab1"), TableKey("tab2")
+	key1, val1 := Key{0: 1}, []byte("value 1")
+	key2, val2 := Key{0: 2}, []byte("value 2")
+
+	tests := []struct {
+		name      string
+		tornBytes int
+		wantFound bool
+	}{{
+		name:      "committed record",
+		tornBytes: 0,
+		wantFound: true,
+	}, {
+		name:      "torn record",
+		tornBytes: 1,
+		wantFound: false,
+	}}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			opts := []Option{WithRootDir(rootDir), WithTables(tab1, tab2)}
+			db, err := NewDB(opts...)
+			require.NoError(t, err)
+
+			// Simulate a crash after the WAL record was written but
+			// before the index files were updated.
+			txc := prepTestTx(t, db, WithWriteTables(tab1, tab2))
+			tx, err := db.BeginTx(txc)
+			require.NoError(t, err)
+			require.NoError(t, tx.Put(tab1, key1, val1).Put(tab2, key2, val2).Err())
+			var entries []walTableEntry
+			for _, tc := range txc.lockOrder {
+				indexData, err := tc.table.prepareCommit()
+				require.NoError(t, err)
+				require.NoError(t, tc.table.dataFile.Sync())
+				entries = append(entries, walTableEntry{
+					table:       tc.key,
+					indexOffset: tc.table.indexSize,
+					indexData:   indexData,
+				})
+			}
+			require.NoError(t, db.wal.commit(entries))
+			walLen := int64(len(db.wal.buf))
+			if tc.tornBytes > 0 {
+				require.NoError(t, db.wal.f.Truncate(walLen-int64(tc.tornBytes)))
+			}
+			for _, tab := range db.tables {
+				require.NoError(t, tab.close())
+			}
+			require.NoError(t, db.wal.close())
+			require.NoError(t, db.dirLock.f.Close())
+
+			// Reopen. The WAL must have been cleared.
+			db, err = NewDB(opts...)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			stat, err := os.Stat(filepath.Join(rootDir, walFileName))
+			require.NoError(t, err)
+			require.Equal(t, int64(0), stat.Size())
+
+			// Either both or none of the values are found.
+			txc = prepTestTx(t, db, WithReadTables(tab1, tab2))
+			runTestTx(t, txc, func(tx Tx) error {
+				require.Equal(t, tc.wantFound, tx.Exists(tab1, key1))
+				require.Equal(t, tc.wantFound, tx.Exists(tab2, key2))
+				if tc.wantFound {
+					require.Equal(t, val1, tx.Get(tab1, key1))
+					require.Equal(t, val2, tx.Get(tab2, key2))
+				}
+				return tx.Err()
+			})
+		})
+	}
+}
+
+// TestWALCommitAfterFailure tests that a WAL record is committed even if a
+// longer record was left in the WAL by a commit that failed.
+func TestWALCommitAfterFailure(t *testing.T) {
+	tableName := TableKey("test")
+	db := newTestDB(t, WithTables(tableName))
+	db.wal.mu.Lock()
+	defer db.wal.mu.Unlock()
+
+	// A long record is left in the WAL (e.g. its fsync failed).
+	long := []walTableEntry{{table: tableName, indexOffset: 1, indexData: make([]byte, 500)}}
+	require.NoError(t, db.wal.commit(long))
+
+	short := []walTableEntry{{table: tableName, indexOffset: 2, indexData: []byte("short")}}
+	require.NoError(t, db.wal.commit(short))
+	_, err := db.wal.f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	record, err := io.ReadAll(db.wal.f)
+	require.NoError(t, err)
+	require.Equal(t, short, decodeWALRecord(record))
+	require.NoError(t, db.wal.clear())
+}
+
+// TestFailedCommitDiscardsData tests that the data appended by a commit that
+// fails before its WAL record is written is discarded.
+func TestFailedCommitDiscardsData(t *testing.T) {
+	tab1, tab2 := TableKey("tab1"), TableKey("tab2")
+	rootDir := t.TempDir()
+	opts := []Option{WithRootDir(rootDir), WithTables(tab1, tab2), WithMaxDataFileSize(300)}
+	db, err := NewDB(opts...)
+	require.NoError(t, err)
+	txc := prepTestTx(t, db, WithWriteTables(tab1, tab2))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tab1, Key{1}, []byte("one")).Put(tab2, Key{1}, []byte("one")).Err()
+	})
+	dataSize := func(n uint32) int64 {
+		t.Helper()
+		stat, err := os.Stat(dataFilePath(rootDir, tab1, n))
+		require.NoError(t, err)
+		return stat.Size()
+	}
+	wantSize := dataSize(0)
+
+	// Make appending to the data file of the second table fail. The first
+	// table starts a new data file for its (large) value before that.
+	require.Equal(t, tab2, txc.lockOrder[1].key)
+	tab := db.tables[tab2]
+	dataFile := tab.dataFile
+	roFile, err := os.Open(dataFile.Name())
+	require.NoError(t, err)
+	tab.dataFile = roFile
+	err = txc.RunTx(func(tx Tx) error {
+		return tx.Put(tab1, Key{2}, make([]byte, 300)).Put(tab2, Key{2}, []byte("two")).Err()
+	})
+	require.Error(t, err)
+	tab.dataFile = dataFile
+	require.NoError(t, roFile.Close())
+
+	// The data of the first table was discarded, and further commits
+	// work.
+	require.Equal(t, wantSize, dataSize(0))
+	require.Equal(t, int64(fileHeaderSize), dataSize(1))
+	runTestTx(t, txc, func(tx Tx) error {
+		return tx.Put(tab1, Key{3}, []byte("three")).Put(tab2, Key{3}, []byte("three")).Err()
+	})
+	require.NoError(t, db.Close())
+
+	report, err := Verify(rootDir, opts...)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Issues)
+	require.Equal(t, map[TableKey]int{tab1: 2, tab2: 2}, report.Records)
+}